@@ -1,21 +1,34 @@
 package otfalign
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/iancoleman/strcase"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
+	"github.com/nsip/otf-align/api"
+	"github.com/nsip/otf-align/internal/cache"
+	"github.com/nsip/otf-align/internal/infer"
+	"github.com/nsip/otf-align/internal/nlp"
 	"github.com/nsip/otf-align/internal/util"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OtfAlignService struct {
@@ -35,39 +48,180 @@ type OtfAlignService struct {
 	niasPort int
 	// the jwt used to acess the nias service
 	niasToken string
+	// guards niasToken, which can be changed by a reload
+	tokenMu sync.RWMutex
+	// serialises reloads of the configuration
+	reloadMu sync.Mutex
 	// the host address of the text classifier service
 	tcHost string
 	// the port of the text classifier service
 	tcPort int
+	// the max number of batch items aligned concurrently
+	batchWorkers int
+	// the max number of items accepted in a batch request
+	maxBatchSize int
+	// the registered alignment methods, keyed by alignMethod name
+	aligners map[string]Aligner
+	// max number of alignment results held in memory, negative to disable caching
+	cacheSize int
+	// lifetime of cached alignment results
+	cacheTTL time.Duration
+	// file used for the on-disk cache tier, empty for memory only
+	cacheFile string
+	// cache of alignment results
+	cache *cache.Cache
+	// timeout for each call to an upstream service
+	upstreamTimeout time.Duration
+	// retry policy for calls to upstream services
+	retryPolicy util.RetryPolicy
+	// consecutive upstream failures before its circuit breaker opens
+	breakerThreshold int
+	// how long an open circuit breaker rejects calls
+	breakerCooldown time.Duration
+	// the n3w service
+	n3w *util.Upstream
+	// the otf-classifier service
+	classifier *util.Upstream
+	// overall deadline for each alignment, 0 for none
+	requestTimeout time.Duration
+	// parent of all request contexts, cancelled on shutdown
+	baseCtx context.Context
+	// cancels baseCtx
+	cancel context.CancelFunc
+	// prometheus metrics
+	metrics *metrics
+	// address of the nats streaming server used by the worker
+	natsURL string
+	// nats streaming cluster id
+	natsCluster string
+	// client id used by the worker to connect to nats streaming
+	natsClientID string
+	// durable subscription name, so the worker resumes after a restart
+	natsDurable string
+	// optional queue group, to share messages between workers
+	natsQueue string
+	// subject the worker consumes otf-reader messages from
+	ingestSubject string
+	// subject the worker publishes aligned messages to
+	alignedSubject string
+	// subject the worker publishes failed messages to
+	deadLetterSubject string
+	// max number of messages the worker aligns concurrently
+	workerConcurrency int
+	// the nats streaming worker, nil unless started
+	worker *worker
+	// rules for extracting align requests from otf-reader messages
+	profiles []ProviderProfile
+	// max number of map records sent to the map backend in each publish call
+	mapBatchSize int
+	// where alignment maps are held, n3w or local
+	mapBackend string
+	// file for the local map store, empty for a temporary store
+	mapStoreFile string
+	// map files loaded into the local map store at startup
+	mapFiles []string
+	// the alignment maps used for mapped alignment
+	maps mapBackend
+	// nlp dataset file, empty to resolve nlp references with the classifier
+	nlpFile string
+	// the local nlp dataset, nil if not loaded
+	nlp *nlp.Dataset
+	// use the classifier for references not in the local nlp dataset
+	classifierFallback bool
+	// how inferred alignment is done, classifier or local
+	inferenceBackend string
+	// the local inference index, nil if the classifier is used
+	inference *infer.Index
+	// min level of log entries written; debug|info|warn|error
+	logLevel string
+	// log entry format; json|text
+	logFormat string
+	// the service logger
+	log *logrus.Entry
+	// where trace spans are exported to; none|stdout|otlp
+	traceExporter string
+	// url of the opentelemetry collector for the otlp exporter
+	traceEndpoint string
+	// fraction of traces started by the service that are recorded
+	traceSampleRatio float64
+	// the tracer provider, nil if spans are not exported
+	tracerProvider *sdktrace.TracerProvider
+	// creates the spans for requests, alignments and upstream calls
+	tracer trace.Tracer
+	// carries trace context in from callers and on to upstreams
+	propagator propagation.TextMapPropagator
+	// shared secret for HS256 bearer tokens
+	jwtSecret string
+	// pem file of the public key for RS256 bearer tokens
+	jwtKeyFile string
+	// json web key set file of keys for bearer tokens
+	jwksFile string
+	// required issuer of bearer tokens, empty for any
+	jwtIssuer string
+	// required audience of bearer tokens, empty for any
+	jwtAudience string
+	// json file of static api keys and their scopes
+	apiKeyFile string
+	// identify the client of each request, no auth if empty
+	authenticators []Authenticator
+	// pem file of the certificate to serve https with, empty for http
+	tlsCertFile string
+	// pem file of the private key of the tls certificate
+	tlsKeyFile string
+	// pem file of the CAs client certificates must be signed by, empty for no client certificates
+	tlsClientCAFile string
+	// tls configuration for serving https, nil for http
+	serverTLS *tls.Config
+	// scheme used to call the nias3 server; http|https
+	niasScheme string
+	// scheme used to call the text classifier; http|https
+	tcScheme string
+	// base urls of the nias3 server replicas, override niasScheme/Host/Port if set
+	niasURLs []string
+	// base urls of the text classifier replicas, override tcScheme/Host/Port if set
+	tcURLs []string
+	// how calls are spread across upstream replicas; round-robin|least-loaded
+	balancePolicy string
+	// consecutive failures that eject an upstream replica, negative to never eject
+	ejectThreshold int
+	// how long an ejected upstream replica is left out
+	ejectTime time.Duration
+	// path of the n3w graphql endpoint, relative to the base url
+	niasGraphQLPath string
+	// path of the n3w publish endpoint, relative to the base url
+	niasPublishPath string
+	// path of the n3w endpoint creating contexts, relative to the base url
+	niasContextPath string
+	// path of the classifier align endpoint, relative to the base url
+	tcAlignPath string
+	// path of the classifier lookup endpoint, relative to the base url
+	tcLookupPath string
+	// pem file of additional CAs trusted for https calls to upstreams
+	upstreamCAFile string
+	// pem file of the client certificate presented to upstreams
+	upstreamCertFile string
+	// pem file of the private key of the upstream client certificate
+	upstreamKeyFile string
+	// requests per second allowed for each client, 0 for no limit
+	rateLimit float64
+	// max burst of requests allowed for each client
+	rateBurst int
+	// per-client rate limits, nil if not limited
+	limiter *clientLimiter
+	// rate limits on failed authentication, by address,
+	// nil if not limited
+	authLimiter *clientLimiter
+	// max number of calls to n3w and the classifier in flight at once, 0 for no limit
+	maxUpstreamCalls int
+	// cap on calls in flight, shared by all upstreams
+	gate *util.Gate
 }
 
 //
 // Query paramters sent to the
-// web service.
-// Params can be provided as json payload, via form components
-// or as query params
-//
-type AlignRequest struct {
-	//
-	// method to be used for alignment one of...
-	// prescribed: results in lookup/passthrough of NLP reference
-	// mapped: maps from input token through known linkages such as Australian Curriculum to find link to NLP
-	// inferred: uses text classifier lookup to try and identify desired NLP
-	//
-	AlignMethod string `json:"alignMethod" form:"alignMethod" query:"alignMethod"`
-	//
-	// parameter to guide chosen method...
-	// prescribed: will typically be an NLP reference. Lookup may still occur to find full extent of GESDI block, or value may simply be passed through/back to user
-	// mapped: will typically be a module or node reference in the providing system, which in turn will be looked up in avialable vendor maps to find link to NLP via (for example) a common Australian Curriculum link
-	// inferred: will typically be a piece of free-form text such as a question or observation
-	//
-	AlignToken interface{} `json:"alignToken" form:"alignToken" query:"alignToken"`
-	//
-	// the general capability the alignment belogs to; the broad
-	// categories of the NPLs; Literacy & Numeracy.
-	//
-	AlignCapability string `json:"alignCapability" form:"alignCapability" query:"alignCapability"`
-}
+// web service, see api.AlignRequest
+//
+type AlignRequest = api.AlignRequest
 
 //
 // create a new service instance
@@ -79,15 +233,102 @@ func New(options ...Option) (*OtfAlignService, error) {
 	if err := srvc.setOptions(options...); err != nil {
 		return nil, err
 	}
+	srvc.initLogging()
+	if err := srvc.initAuth(); err != nil {
+		return nil, err
+	}
+	srvc.registerDefaultAligners()
+	srvc.registerDefaultProviderProfiles()
+	if err := srvc.initNLP(); err != nil {
+		return nil, err
+	}
+	if err := srvc.initInference(); err != nil {
+		return nil, err
+	}
+	if err := srvc.initTracing(); err != nil {
+		return nil, err
+	}
+	if (srvc.tlsCertFile == "") != (srvc.tlsKeyFile == "") {
+		return nil, errors.New("tls requires both a certificate and a key file")
+	}
+	if srvc.tlsClientCAFile != "" && srvc.tlsCertFile == "" {
+		return nil, errors.New("client certificates can only be verified when tls is enabled")
+	}
+	if srvc.tlsCertFile != "" {
+		cfg, err := util.ServerTLSConfig(srvc.tlsCertFile, srvc.tlsKeyFile, srvc.tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		srvc.serverTLS = cfg
+	}
+	if err := srvc.initUpstreams(); err != nil {
+		return nil, err
+	}
+	if err := srvc.initMaps(); err != nil {
+		srvc.shutdownTracing()
+		return nil, err
+	}
+
+	if srvc.cacheSize >= 0 {
+		c, err := cache.New(cacheSizeOrDefault(srvc.cacheSize), srvc.cacheTTL, srvc.cacheFile)
+		if err != nil {
+			srvc.maps.close()
+			srvc.shutdownTracing()
+			return nil, err
+		}
+		srvc.cache = c
+	}
+	srvc.initMetrics()
 
 	srvc.e = echo.New()
-	srvc.e.Logger.SetLevel(log.INFO)
+	// startup and requests are reported by the service logger
+	srvc.e.HideBanner = true
+	srvc.e.HidePort = true
+	// errors from the http server itself, such as failed tls handshakes
+	srvc.e.StdLogger = stdlog.New(srvc.log.WriterLevel(logrus.WarnLevel), "", 0)
+	srvc.e.HTTPErrorHandler = srvc.errorHandler
+	srvc.e.Use(requestID(), srvc.tracing(), srvc.requestLogger(), srvc.authenticate())
+	if srvc.rateLimit > 0 {
+		burst := srvc.rateBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(srvc.rateLimit))
+		}
+		srvc.limiter = newClientLimiter(srvc.rateLimit, burst)
+		if len(srvc.authenticators) > 0 {
+			srvc.authLimiter = newClientLimiter(srvc.rateLimit, burst)
+		}
+		srvc.e.Use(srvc.rateLimiter())
+	}
+	// derive all request contexts from the service context so
+	// in-flight upstream calls are aborted on shutdown
+	srvc.baseCtx, srvc.cancel = context.WithCancel(context.Background())
+	srvc.e.Server.BaseContext = func(net.Listener) context.Context {
+		return srvc.baseCtx
+	}
+	srvc.e.TLSServer.BaseContext = srvc.e.Server.BaseContext
 	// add pingable method to know we're up
 	srvc.e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, "OK")
 	})
+	// add liveness and readiness checks
+	srvc.e.GET("/healthz", srvc.buildHealthHandler())
+	srvc.e.GET("/readyz", srvc.buildReadyHandler())
 	// add align method
 	srvc.e.POST("/align", srvc.buildAlignHandler())
+	// add batch align method
+	srvc.e.POST("/align/batch", srvc.buildBatchAlignHandler())
+	// add otf-reader message align method
+	srvc.e.POST("/align/envelope", srvc.buildEnvelopeAlignHandler())
+	// add cache admin methods
+	srvc.e.GET("/admin/cache", srvc.buildCacheStatsHandler(), requireScope("admin"))
+	srvc.e.DELETE("/admin/cache", srvc.buildCachePurgeHandler(), requireScope("admin"))
+	// add alignment map ingestion methods
+	srvc.e.POST("/maps", srvc.buildMapsHandler(), requireScope("maps:admin"))
+	srvc.e.POST("/maps/validate", srvc.buildMapsValidateHandler(), requireScope("maps:admin"))
+	// add upstream status method
+	srvc.e.GET("/admin/upstreams", srvc.buildUpstreamStatusHandler(), requireScope("admin"))
+	// add prometheus metrics
+	srvc.e.GET("/metrics", srvc.buildMetricsHandler())
 
 	return &srvc, nil
 }
@@ -95,7 +336,8 @@ func New(options ...Option) (*OtfAlignService, error) {
 //
 // creates the main align method
 // requires an input of request variables (in json)
-// alignMethod: one of (prescribed|mapped|inferred)
+// alignMethod: one of (prescribed|mapped|inferred) or the
+// name of any custom Aligner registered with the service
 // alignToken: string (reference such as an AC ref for mapped alignment,
 // or the text to be used as input
 // to the text classifier for inferred alignment)
@@ -103,100 +345,181 @@ func New(options ...Option) (*OtfAlignService, error) {
 //
 func (s *OtfAlignService) buildAlignHandler() echo.HandlerFunc {
 
-	tcURL := fmt.Sprintf("http://%s:%d/align", s.tcHost, s.tcPort)            // text classifier address
-	niasURL := fmt.Sprintf("http://%s:%d/n3/graphql", s.niasHost, s.niasPort) // n3w address
-	n3Token := s.niasToken
-	sName := s.serviceName
-	sID := s.serviceID
-	tclkpBaseURL := fmt.Sprintf("http://%s:%d/lookup", s.tcHost, s.tcPort)
-
 	return func(c echo.Context) error {
 		// check required params are in input
 		ar := &AlignRequest{}
 		if err := c.Bind(ar); err != nil {
-			fmt.Println("bind error: ", err)
+			s.logger(c.Request().Context()).WithError(err).Warn("cannot bind align request")
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
 
-		// token could be any json type so convert to string
-		stringToken := fmt.Sprintf("%v", ar.AlignToken)
-
-		if ar.AlignMethod == "" || stringToken == "" || ar.AlignCapability == "" {
-			return echo.NewHTTPError(http.StatusBadRequest, "must supply values for alignMethod, alignToken and alignCapability")
+		alignResponse, err := s.align(c.Request().Context(), ar)
+		if err != nil {
+			return err
 		}
 
-		// set default request headers
-		headers := map[string]string{
-			"Content-Type": "application/json",
-			"Accept":       "application/json",
-			"Connection":   "keep-alive",
-			"DNT":          "1",
+		return c.JSON(http.StatusOK, alignResponse)
+
+	}
+}
+
+//
+// performs a single alignment request against the
+// configured services
+//
+// ctx: the request context, cancelling it aborts any upstream calls;
+// the configured request timeout is applied on top of it
+//
+// returns the response structure for conversion to json,
+// or an echo.HTTPError describing the failure
+//
+func (s *OtfAlignService) align(ctx context.Context, ar *AlignRequest) (resp *AlignResponse, err error) {
+
+	sName := s.serviceName
+	sID := s.serviceID
+
+	// upstream calls are logged with the alignment details
+	l := s.logger(ctx).WithFields(logrus.Fields{
+		"alignMethod":     ar.AlignMethod,
+		"alignCapability": ar.AlignCapability,
+	})
+	ctx = withLogger(ctx, l)
+
+	start := time.Now()
+	defer func() {
+		status := http.StatusOK
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
 		}
-		// call the relevant services for the align method
-		nlps := []map[string]interface{}{}
-		switch ar.AlignMethod {
-		case "mapped":
-			headers["Authorization"] = n3Token // add n3 auth token
-			// find any nlp links with query to n3w
-			nlpRefs, err := mappedAlignment(stringToken, niasURL, headers)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
-			// for links returned now lookup full gesdi blocks
-			for _, ref := range nlpRefs {
-				results, err := prescribedAlignment(ref, tclkpBaseURL, headers)
-				if err != nil {
-					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-				}
-				nlps = append(nlps, results...)
-			}
-			// this block creates a failsafe, if no mapped results were found
-			// forces a fallthrough to perform an inferred lookup
-			if len(nlpRefs) != 0 {
-				break
-			}
-			fmt.Println("no mapped results found, falling back to inference")
-			fallthrough
-		case "inferred":
-			results, err := inferredAlignment(stringToken, ar.AlignCapability, tcURL, headers)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
-			nlps = append(nlps, results...)
-		case "prescribed":
-			results, err := prescribedAlignment(stringToken, tclkpBaseURL, headers)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
-			nlps = append(nlps, results...)
+		s.observeAlignment(ar, status, time.Since(start))
+
+		l = l.WithFields(logrus.Fields{"status": status, "durationMs": millis(time.Since(start))})
+		switch {
+		case status >= 500:
+			l.WithError(err).Warn("alignment failed")
+		case err != nil:
+			l.WithError(err).Info("alignment rejected")
 		default:
-			_ = niasURL
-			return echo.NewHTTPError(http.StatusBadRequest, "alignMethod not supported")
+			l.WithFields(logrus.Fields{
+				"effectiveMethod": resp.EffectiveMethod,
+				"alignments":      len(resp.Alignments),
+			}).Debug("alignment completed")
 		}
-		// put the whole response together
-		alignResponse := map[string]interface{}{
-			"alignments":       nlps,
-			"alignMethod":      ar.AlignMethod,
-			"alignToken":       ar.AlignToken,
-			"alignCapability":  ar.AlignCapability,
-			"alignServiceID":   sID,
-			"alignServiceName": sName,
+	}()
+
+	if ar.AlignMethod == "" || ar.Token() == "" || ar.AlignCapability == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "must supply values for alignMethod, alignToken and alignCapability")
+	}
+
+	// the client must be allowed to use the align method
+	if err := authorize(ctx, "align:"+ar.AlignMethod); err != nil {
+		return nil, err
+	}
+	// call the relevant aligner for the align method
+	aligner := s.aligner(ar.AlignMethod)
+	if aligner == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "alignMethod not supported")
+	}
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+	ctx, span := s.startSpan(ctx, "align "+ar.AlignMethod,
+		attribute.String("align.method", ar.AlignMethod),
+		attribute.String("align.capability", ar.AlignCapability),
+	)
+	nlps, err := aligner.Align(ctx, ar)
+	span.SetAttributes(attribute.Int("align.results", len(nlps)))
+	endSpan(span, err)
+	if err != nil {
+		if errors.Is(err, util.ErrTooManyCalls) {
+			s.observeRateLimited("upstream")
 		}
+		return nil, alignError(err)
+	}
+	effectiveMethod, fallback := summariseProvenance(ar.AlignMethod, nlps)
+	// put the whole response together
+	alignResponse := &AlignResponse{
+		Alignments:       nlps,
+		AlignMethod:      ar.AlignMethod,
+		EffectiveMethod:  effectiveMethod,
+		Fallback:         fallback,
+		AlignToken:       ar.AlignToken,
+		AlignCapability:  ar.AlignCapability,
+		AlignServiceID:   sID,
+		AlignServiceName: sName,
+	}
 
-		return c.JSON(http.StatusOK, alignResponse)
+	return alignResponse, nil
+}
+
+//
+// converts an error from an aligner into the
+// http error returned to the caller
+//
+func alignError(err error) *echo.HTTPError {
+
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he
+	}
+	// too many upstream calls in flight, tell caller to back off
+	if errors.Is(err, util.ErrTooManyCalls) {
+		return tooManyRequests(err.Error(), time.Second)
+	}
+	// the cause is kept as the internal error, so callers
+	// such as the worker can tell upstream failures apart
+
+	// upstream known to be down, tell caller to back off
+	if errors.Is(err, util.ErrCircuitOpen) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error()).SetInternal(err)
+	}
+	// request deadline passed before alignment completed
+	if errors.Is(err, context.DeadlineExceeded) {
+		return echo.NewHTTPError(http.StatusGatewayTimeout, err.Error()).SetInternal(err)
+	}
+	// caller went away or service is shutting down
+	if errors.Is(err, context.Canceled) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error()).SetInternal(err)
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error()).SetInternal(err)
+}
 
+//
+// reads a request body of up to limit bytes
+//
+// returns an echo.HTTPError, 413 Request Entity Too Large
+// if the body is larger than the limit
+//
+func readBody(c echo.Context, limit int64) ([]byte, error) {
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body is larger than the max of %d bytes", limit))
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	return body, nil
 }
 
 //
-// start the service running
+// start the service running, over https if a tls
+// certificate has been configured
 //
 func (s *OtfAlignService) Start() {
 
 	address := fmt.Sprintf("%s:%d", s.serviceHost, s.servicePort)
+	s.log.WithFields(logrus.Fields{
+		"address": address,
+		"tls":     s.serverTLS != nil,
+		"mtls":    s.serverTLS != nil && s.serverTLS.ClientCAs != nil,
+	}).Info("http server starting")
 	go func(addr string) {
-		if err := s.e.Start(addr); err != nil {
-			s.e.Logger.Info("error starting server: ", err, ", shutting down...")
+		if err := s.start(addr); err != nil {
+			s.log.WithError(err).Info("http server stopped, shutting down...")
 			// attempt clean shutdown by raising sig int
 			p, _ := os.FindProcess(os.Getpid())
 			p.Signal(os.Interrupt)
@@ -205,22 +528,42 @@ func (s *OtfAlignService) Start() {
 
 }
 
+//
+// serves requests at the address until the server is shut down
+//
+func (s *OtfAlignService) start(addr string) error {
+
+	if s.serverTLS == nil {
+		return s.e.Start(addr)
+	}
+	srv := s.e.TLSServer
+	srv.Addr = addr
+	srv.TLSConfig = s.serverTLS
+	if !s.e.DisableHTTP2 {
+		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, "h2")
+	}
+	return s.e.StartServer(srv)
+}
+
 //
 // calls the n3w server to find linked nlps
 //
+// ctx: cancelling the context aborts the lookup
+// up: the n3w upstream
 // token: the search token
-// url: the url of the n3w server
+// path: the path of the n3w graphql endpoint
 // headers: http headers to support the request
 //
-// returns array of aligned nlp references
+// returns array of links to aligned nlps
 //
-func mappedAlignment(token, url string, headers map[string]string) ([]string, error) {
+func mappedAlignment(ctx context.Context, up *util.Upstream, token, path string, headers map[string]string) ([]NLPLink, error) {
 
 	method := "POST"
-	body := bytes.NewBuffer(buildQuery(token))
+	body := buildQuery(token)
 
 	// call the n3 service to find any nlp matches
-	res, err := util.Fetch(method, url, headers, body)
+	// graphql query is read-only so can be retried
+	res, err := up.Fetch(ctx, method, path, headers, body, true)
 	if err != nil {
 		return nil, err
 	}
@@ -229,19 +572,61 @@ func mappedAlignment(token, url string, headers map[string]string) ([]string, er
 }
 
 //
-// finds the aligned nlp identifiers from the results of an
+// a link from a provider item to an nlp, as found
+// by traversing the n3w alignment maps
+//
+type NLPLink struct {
+	// the common reference (e.g. AC code) linking provider item and nlp
+	LinkReference string `json:"linkReference"`
+	// n3 node id of the link
+	NLPNodeID string `json:"nlpNodeId"`
+	// the nlp the link points to
+	NLPReference string `json:"nlpReference"`
+	// version of the link map
+	NLPLinkVersion string `json:"nlpLinkVersion"`
+	// the provider whose item was matched
+	ProviderName string `json:"providerName"`
+	// the provider's own identifier for the item
+	ExternalReference string `json:"externalReference"`
+	// version of the provider item
+	ItemVersion string `json:"itemVersion"`
+}
+
+//
+// finds the aligned nlp links from the results of an
 // n3 (mapped) query.
+// each link is annotated with the provider item it was
+// reached from, the item sharing its linkReference.
 //
-// returns an arrray of identifiers, which can be empty
+// returns an arrray of links, which can be empty
 // if no matches were found
 //
-func extractN3AlignmentMatches(n3response []byte) []string {
+func extractN3AlignmentMatches(n3response []byte) []NLPLink {
 
-	matches := make([]string, 0)
+	matches := make([]NLPLink, 0)
 
-	result := gjson.GetBytes(n3response, "data.q.OtfNLPLink.#.nlpReference")
-	for _, ref := range result.Array() {
-		matches = append(matches, ref.String())
+	items := map[string]gjson.Result{}
+	for _, item := range gjson.GetBytes(n3response, "data.q.OtfProviderItem").Array() {
+		ref := item.Get("linkReference").String()
+		if _, ok := items[ref]; !ok {
+			items[ref] = item
+		}
+	}
+	result := gjson.GetBytes(n3response, "data.q.OtfNLPLink")
+	for _, link := range result.Array() {
+		if link.Get("nlpReference").String() == "" {
+			continue
+		}
+		item := items[link.Get("linkReference").String()]
+		matches = append(matches, NLPLink{
+			LinkReference:     link.Get("linkReference").String(),
+			NLPNodeID:         link.Get("nlpNodeId").String(),
+			NLPReference:      link.Get("nlpReference").String(),
+			NLPLinkVersion:    link.Get("nlpLinkVersion").String(),
+			ProviderName:      item.Get("providerName").String(),
+			ExternalReference: item.Get("externalReference").String(),
+			ItemVersion:       item.Get("itemVersion").String(),
+		})
 	}
 
 	return matches
@@ -252,18 +637,20 @@ func extractN3AlignmentMatches(n3response []byte) []string {
 // calls the text-classfication server to find the
 // nlp gesdi block for the specified token
 //
+// ctx: cancelling the context aborts the lookup
+// up: the otf-classifier upstream
 // token: the search token
-// url: the url of the text-class server
+// path: the path of the text-class lookup endpoint
 // headers: http headers to support the request
 //
-// returns array of aligned nlp objects (map[string]interface{} for conversion to json)
+// returns array of aligned nlp objects
 //
-func prescribedAlignment(token, url string, headers map[string]string) ([]map[string]interface{}, error) {
+func prescribedAlignment(ctx context.Context, up *util.Upstream, token, path string, headers map[string]string) ([]Alignment, error) {
 
 	method := "GET"
-	tcurl := fmt.Sprintf(`%s?search=%s`, url, token)
+	tcurl := fmt.Sprintf(`%s?search=%s`, path, token)
 	// call the text-classfier lookup service
-	res, err := util.Fetch(method, tcurl, headers, nil)
+	res, err := up.Fetch(ctx, method, tcurl, headers, nil, true)
 	if err != nil {
 		return nil, err
 	}
@@ -276,25 +663,28 @@ func prescribedAlignment(token, url string, headers map[string]string) ([]map[st
 // nlp gesdi block based on searching for best match to the
 // supplied text (typically a phrase or description)
 //
+// ctx: cancelling the context aborts the lookup
+// up: the otf-classifier upstream
 // token: the search token
 // capability: text-class needs broad area (literacy/numeracy)
-// url: the url of the text-class server
+// path: the path of the text-class align endpoint
 // headers: http headers to support the request
+// maxResults: the max number of ranked candidates to return
+// minScore: candidates scored below this by the classifier are discarded
 //
-// returns array of aligned nlp objects (map[string]interface{} for conversion to json)
+// returns array of aligned nlp objects
 //
-
-func inferredAlignment(token, capability, url string, headers map[string]string) ([]map[string]interface{}, error) {
+func inferredAlignment(ctx context.Context, up *util.Upstream, token, capability, path string, headers map[string]string, maxResults int, minScore float64) ([]Alignment, error) {
 
 	method := "POST"
 	requestJson := []byte(fmt.Sprintf(`{"area":"%s", "text":%q}`, capability, token))
-	body := bytes.NewReader(requestJson)
 	// call the text classifier service
-	res, err := util.Fetch(method, url, headers, body)
+	// classification has no side-effects so can be retried
+	res, err := up.Fetch(ctx, method, path, headers, requestJson, true)
 	if err != nil {
 		return nil, err
 	}
-	return reformatClassifierResponse(res)
+	return reformatClassifierResponse(res, maxResults, minScore)
 
 }
 
@@ -330,6 +720,7 @@ func buildQuery(token string) []byte {
 				providerName 
 				externalReference 
 				itemVersion
+				linkReference
 			}  
 		}
 	}`
@@ -345,7 +736,7 @@ func buildQuery(token string) []byte {
 	gql := GQLQuery{Query: q, Variables: v}
 	jsonStr, err := json.Marshal(gql)
 	if err != nil {
-		fmt.Println("gql query json marshal error: ", err)
+		logrus.WithError(err).Error("gql query json marshal error")
 	}
 
 	return jsonStr
@@ -354,46 +745,71 @@ func buildQuery(token string) []byte {
 //
 // create the simplified return structure
 // cr: payload returned by otf-classifier as bytes
+// maxResults: the max number of candidates to return
+// minScore: candidates with a lower classifier score are discarded
 //
-// returns an array of nlp objects ([]map[string]interface{})
-// to be converted to json
+// candidates are returned in the ranked order provided by
+// the classifier, each annotated with its score and rank
+// (1 being the best match)
 //
-func reformatClassifierResponse(cr []byte) ([]map[string]interface{}, error) {
+// returns an array of nlp alignments
+//
+func reformatClassifierResponse(cr []byte, maxResults int, minScore float64) ([]Alignment, error) {
 
-	// // return just first entry - highest match
 	var clResp []map[string]interface{}
 	err := json.Unmarshal(cr, &clResp)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to unmarshal response from classifier")
 	}
-	firstRec := clResp[0]
 
-	alignments := []map[string]interface{}{}
-	alignment := map[string]interface{}{
-		"itemID":           firstRec["Item"],
-		"developmentLevel": firstRec["DevLevel"],
-		"itemText":         firstRec["Text"],
-	}
-	// convert paths array into object
-	paths := firstRec["Path"].([]interface{})
-	for _, path := range paths {
-		p := path.(map[string]interface{})
-		key := strcase.ToLowerCamel(p["Key"].(string)) // ensure keys work as json keys
-		alignment[key] = p["Val"]
+	alignments := []Alignment{}
+	for _, rec := range clResp {
+		if len(alignments) >= maxResults {
+			break
+		}
+		score, _ := rec["Score"].(float64)
+		if score < minScore {
+			continue
+		}
+		alignment := Alignment{Score: score}
+		setPathValue(&alignment, "itemID", rec["Item"])
+		setPathValue(&alignment, "developmentLevel", rec["DevLevel"])
+		setPathValue(&alignment, "itemText", rec["Text"])
+		// convert paths array into fields
+		paths, _ := rec["Path"].([]interface{})
+		for _, path := range paths {
+			p, ok := path.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			setPathValue(&alignment, fmt.Sprintf("%v", p["Key"]), p["Val"])
+		}
+		alignments = append(alignments, alignment)
 	}
-	alignments = append(alignments, alignment)
+	rankAlignments(alignments)
 
 	return alignments, nil
 }
 
+//
+// ranks alignments by their order, best first; done once
+// any below the min score have been discarded so ranks
+// always run from 1 without gaps
+//
+func rankAlignments(alignments []Alignment) {
+
+	for i := range alignments {
+		alignments[i].Rank = i + 1
+	}
+}
+
 //
 // create the simplified return structure
 // cr: payload returned by otf-classifier as bytes
 //
-// returns an array of nlp objects ([]map[string]interface{})
-// to be converted to json
+// returns an array of nlp alignments
 //
-func reformatClassifierLookupResponse(cr []byte) ([]map[string]interface{}, error) {
+func reformatClassifierLookupResponse(cr []byte) ([]Alignment, error) {
 
 	var clResp []map[string]interface{}
 	err := json.Unmarshal(cr, &clResp)
@@ -401,13 +817,11 @@ func reformatClassifierLookupResponse(cr []byte) ([]map[string]interface{}, erro
 		return nil, errors.Wrap(err, "unable to unmarshal response from classifier lookup")
 	}
 
-	// convert paths array into object
-	alignments := []map[string]interface{}{}
-	alignment := map[string]interface{}{}
-	for _, path := range clResp {
-		p := path
-		key := strcase.ToLowerCamel(p["Key"].(string)) // ensure keys work as json keys
-		alignment[key] = p["Val"]
+	// convert paths array into fields
+	alignments := []Alignment{}
+	alignment := Alignment{}
+	for _, p := range clResp {
+		setPathValue(&alignment, fmt.Sprintf("%v", p["Key"]), p["Val"])
 	}
 	alignments = append(alignments, alignment)
 
@@ -417,25 +831,44 @@ func reformatClassifierLookupResponse(cr []byte) ([]map[string]interface{}, erro
 
 //
 // shut the server down gracefully
+// in-flight requests are given 10 seconds to complete,
+// after which their upstream calls are cancelled
 //
 func (s *OtfAlignService) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	defer s.cancel()
+	s.stopWorker()
 	if err := s.e.Shutdown(ctx); err != nil {
-		fmt.Println("could not shut down server cleanly: ", err)
-		s.e.Logger.Fatal(err)
+		s.log.WithError(err).Fatal("could not shut down server cleanly")
+	}
+	if s.cache != nil {
+		if err := s.cache.Close(); err != nil {
+			s.log.WithError(err).Error("could not close cache cleanly")
+		}
 	}
+	if err := s.maps.close(); err != nil {
+		s.log.WithError(err).Error("could not close map store cleanly")
+	}
+	s.shutdownTracing()
 
 }
 
 func (s *OtfAlignService) PrintConfig() {
 
 	fmt.Println("\n\tOTF-Align Service Configuration")
-	fmt.Println("\t---------------------------------\n")
+	fmt.Print("\t---------------------------------\n\n")
 
 	s.printID()
 	s.printNiasConfig()
 	s.printClassifierConfig()
+	s.printBatchConfig()
+	s.printAlignerConfig()
+	s.printProviderConfig()
+	s.printCacheConfig()
+	s.printUpstreamConfig()
+	s.printAuthConfig()
+	s.printWorkerConfig()
 
 }
 
@@ -444,18 +877,126 @@ func (s *OtfAlignService) printID() {
 	fmt.Println("\tservice ID:\t\t", s.serviceID)
 	fmt.Println("\tservice host:\t\t", s.serviceHost)
 	fmt.Println("\tservice port:\t\t", s.servicePort)
+	switch {
+	case s.serverTLS == nil:
+		fmt.Println("\tservice tls:\t\t disabled")
+	case s.serverTLS.ClientCAs != nil:
+		fmt.Println("\tservice tls:\t\t enabled, client certificates required")
+	default:
+		fmt.Println("\tservice tls:\t\t enabled")
+	}
 }
 
 func (s *OtfAlignService) printNiasConfig() {
-	fmt.Println("\tnias n3w host:\t\t", s.niasHost)
-	fmt.Println("\tnias n3w port:\t\t", s.niasPort)
+	fmt.Println("\tnias n3w url:\t\t", strings.Join(s.n3w.Endpoints.URLs(), ", "))
+	fmt.Println("\tn3w endpoints:\t\t", s.niasGraphQLPath, s.niasPublishPath, s.niasContextPath)
 	// display only a partial token
-	tokenParts := strings.Split(s.niasToken, ".")
+	tokenParts := strings.Split(s.n3wToken(), ".")
 	partialToken := tokenParts[len(tokenParts)-1]
 	fmt.Println("\tn3w token(partial):\t", partialToken)
 }
 
 func (s *OtfAlignService) printClassifierConfig() {
-	fmt.Println("\totf-class host:\t\t", s.tcHost)
-	fmt.Println("\totf-class port:\t\t", s.tcPort)
+	fmt.Println("\totf-class url:\t\t", strings.Join(s.classifier.Endpoints.URLs(), ", "))
+	fmt.Println("\totf-class endpoints:\t", s.tcAlignPath, s.tcLookupPath)
+	if s.nlp != nil {
+		fmt.Println("\tnlp file:\t\t", s.nlpFile)
+		fmt.Println("\tnlp version:\t\t", s.nlp.Version)
+		fmt.Println("\tclassifier fallback:\t", s.classifierFallback)
+	}
+	if s.inference != nil {
+		fmt.Println("\tinference:\t\t local")
+	}
+}
+
+func (s *OtfAlignService) printBatchConfig() {
+	fmt.Println("\tbatch workers:\t\t", s.batchWorkers)
+	fmt.Println("\tmax batch size:\t\t", s.maxBatchSize)
+	fmt.Println("\tmap batch size:\t\t", s.mapBatchSize)
+	fmt.Println("\tmap backend:\t\t", s.maps)
+}
+
+func (s *OtfAlignService) printAlignerConfig() {
+	methods := make([]string, 0, len(s.aligners))
+	for name := range s.aligners {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	fmt.Println("\talign methods:\t\t", strings.Join(methods, ", "))
+}
+
+func (s *OtfAlignService) printProviderConfig() {
+	providers := make([]string, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		providers = append(providers, p.Name)
+	}
+	fmt.Println("\tproviders:\t\t", strings.Join(providers, ", "))
+}
+
+func (s *OtfAlignService) printCacheConfig() {
+	if s.cache == nil {
+		fmt.Println("\tcache:\t\t\t disabled")
+		return
+	}
+	fmt.Println("\tcache size:\t\t", s.cacheSize)
+	fmt.Println("\tcache ttl:\t\t", s.cacheTTL)
+	fmt.Println("\tcache file:\t\t", s.cacheFile)
+}
+
+func (s *OtfAlignService) printUpstreamConfig() {
+	fmt.Println("\tupstream timeout:\t", s.upstreamTimeout)
+	fmt.Println("\tupstream retries:\t", s.n3w.Retry.Retries)
+	fmt.Println("\tbreaker threshold:\t", s.breakerThreshold)
+	fmt.Println("\tbreaker cooldown:\t", s.breakerCooldown)
+	if s.n3w.Endpoints.Len() > 1 || s.classifier.Endpoints.Len() > 1 {
+		fmt.Println("\tupstream balance:\t", s.balancePolicy)
+		fmt.Println("\teject threshold:\t", s.ejectThreshold)
+		fmt.Println("\teject time:\t\t", s.ejectTime)
+	}
+	fmt.Println("\trequest timeout:\t", s.requestTimeout)
+	if s.gate != nil {
+		fmt.Println("\tmax upstream calls:\t", s.maxUpstreamCalls)
+	}
+	if s.limiter != nil {
+		fmt.Printf("\trate limit:\t\t %g/s per client, burst %d\n", s.rateLimit, s.limiter.burst)
+	}
+	if s.upstreamCAFile != "" {
+		fmt.Println("\tupstream CA file:\t", s.upstreamCAFile)
+	}
+	if s.upstreamCertFile != "" {
+		fmt.Println("\tupstream cert file:\t", s.upstreamCertFile)
+	}
+	fmt.Println("\tlog level:\t\t", s.log.Logger.GetLevel())
+	fmt.Println("\ttrace exporter:\t\t", s.traceExporter)
+	if s.traceExporter == "otlp" {
+		fmt.Println("\ttrace endpoint:\t\t", s.traceEndpoint)
+	}
+}
+
+func (s *OtfAlignService) printAuthConfig() {
+	if len(s.authenticators) == 0 {
+		fmt.Println("\tauth:\t\t\t disabled")
+		return
+	}
+	methods := make([]string, 0, len(s.authenticators))
+	for _, a := range s.authenticators {
+		if st, ok := a.(fmt.Stringer); ok {
+			methods = append(methods, st.String())
+			continue
+		}
+		methods = append(methods, "custom")
+	}
+	fmt.Println("\tauth:\t\t\t", strings.Join(methods, ", "))
+}
+
+func (s *OtfAlignService) printWorkerConfig() {
+	if s.worker == nil {
+		return
+	}
+	fmt.Println("\tnats url:\t\t", s.natsURL)
+	fmt.Println("\tnats cluster:\t\t", s.natsCluster)
+	fmt.Println("\tnats client id:\t\t", s.natsClientID)
+	fmt.Println("\tingest subject:\t\t", s.ingestSubject)
+	fmt.Println("\taligned subject:\t", s.alignedSubject)
+	fmt.Println("\tdead-letter subject:\t", s.deadLetterSubject)
 }
@@ -0,0 +1,57 @@
+package otfalign
+
+import (
+	"testing"
+)
+
+func TestExtractN3AlignmentMatchesProvenance(t *testing.T) {
+
+	res := []byte(`{"data": {"q": {
+		"OtfProviderItem": [
+			{"providerName": "MathsPathway", "externalReference": "MOD1", "itemVersion": "1", "linkReference": "LINK-A"},
+			{"providerName": "MathsPathway", "externalReference": "MOD2", "itemVersion": "2", "linkReference": "LINK-B"}
+		],
+		"OtfNLPLink": [
+			{"linkReference": "LINK-B", "nlpReference": "NLP-B", "nlpLinkVersion": "1"},
+			{"linkReference": "LINK-A", "nlpReference": "NLP-A", "nlpLinkVersion": "1"},
+			{"linkReference": "LINK-C", "nlpReference": "NLP-C", "nlpLinkVersion": "1"}
+		]
+	}}}`)
+
+	links := extractN3AlignmentMatches(res)
+	if len(links) != 3 {
+		t.Fatalf("expected 3 links, got %d", len(links))
+	}
+	expected := map[string]string{"NLP-A": "MOD1", "NLP-B": "MOD2", "NLP-C": ""}
+	for _, l := range links {
+		if l.ExternalReference != expected[l.NLPReference] {
+			t.Errorf("link to %s credited to item %q, expected %q",
+				l.NLPReference, l.ExternalReference, expected[l.NLPReference])
+		}
+	}
+}
+
+func TestReformatClassifierResponseRanks(t *testing.T) {
+
+	res := []byte(`[
+		{"Item": "nlp-1", "Score": 0.2},
+		{"Item": "nlp-2", "Score": 0.9},
+		{"Item": "nlp-3", "Score": 0.1},
+		{"Item": "nlp-4", "Score": 0.7},
+		{"Item": "nlp-5", "Score": 0.8}
+	]`)
+
+	alignments, err := reformatClassifierResponse(res, 2, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"nlp-2", "nlp-4"}
+	if len(alignments) != len(expected) {
+		t.Fatalf("expected %d alignments, got %d", len(expected), len(alignments))
+	}
+	for i, a := range alignments {
+		if a.ItemID != expected[i] || a.Rank != i+1 {
+			t.Errorf("result %d: expected %s ranked %d, got %s ranked %d", i, expected[i], i+1, a.ItemID, a.Rank)
+		}
+	}
+}
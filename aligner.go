@@ -0,0 +1,234 @@
+package otfalign
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//
+// an Aligner implements a single alignment method.
+// Aligners are registered with the service by name, and are
+// selected by the alignMethod parameter of an align request.
+//
+// The built-in mapped, inferred and prescribed methods are
+// registered by default; custom methods can be added (or the
+// built-ins replaced) with the Aligners() option.
+//
+type Aligner interface {
+	//
+	// the alignMethod value that selects this aligner
+	//
+	Name() string
+	//
+	// aligns the request to the NLPs
+	// the context is cancelled if the caller disconnects, the
+	// request deadline passes or the service is shut down
+	// returns array of aligned nlp gesdi blocks
+	// errors of type *echo.HTTPError are returned to the caller unchanged,
+	// any other error is reported as an internal server error
+	//
+	Align(ctx context.Context, ar *AlignRequest) ([]Alignment, error)
+}
+
+//
+// adds an aligner to the service registry,
+// replacing any aligner already registered under the
+// same name
+//
+func (s *OtfAlignService) registerAligner(a Aligner) error {
+	if a == nil || a.Name() == "" {
+		return errors.New("aligner must have a name")
+	}
+	if s.aligners == nil {
+		s.aligners = map[string]Aligner{}
+	}
+	s.aligners[a.Name()] = a
+	return nil
+}
+
+//
+// registers the built-in alignment methods
+// unless they have already been provided as options
+//
+func (s *OtfAlignService) registerDefaultAligners() {
+	defaults := []Aligner{
+		&mappedAligner{s: s},
+		&inferredAligner{s: s},
+		&prescribedAligner{s: s},
+	}
+	for _, a := range defaults {
+		if _, ok := s.aligners[a.Name()]; ok {
+			continue
+		}
+		_ = s.registerAligner(a)
+	}
+}
+
+//
+// finds the aligner registered for the given method,
+// returns nil if no such method is registered
+//
+func (s *OtfAlignService) aligner(method string) Aligner {
+	return s.aligners[method]
+}
+
+//
+// returns the standard set of headers sent
+// to upstream services
+//
+func defaultHeaders() map[string]string {
+	return map[string]string{
+		"Content-Type": "application/json",
+		"Accept":       "application/json",
+		"Connection":   "keep-alive",
+		"DNT":          "1",
+	}
+}
+
+//
+// aligns by finding nlp links for the token in the
+// alignment maps (n3w or local), then looking up the full gesdi block for each
+// link.
+// if no mapped results are found falls back to inference,
+// unless the request disables fallback
+//
+type mappedAligner struct {
+	s *OtfAlignService
+}
+
+func (ma *mappedAligner) Name() string { return "mapped" }
+
+func (ma *mappedAligner) Align(ctx context.Context, ar *AlignRequest) ([]Alignment, error) {
+
+	headers := defaultHeaders()
+	headers["Authorization"] = ma.s.n3wToken() // add n3 auth token
+	// find any nlp links in the alignment maps
+	var nlpLinks []NLPLink
+	key := cacheKey("mapped", ar.AlignCapability, ar.Token())
+	lctx, span := ma.s.startSpan(ctx, "maps links", attribute.String("maps.backend", ma.s.maps.String()))
+	err := ma.s.cached(key, &nlpLinks, func() (err error) {
+		nlpLinks, err = ma.s.maps.links(lctx, ar.Token())
+		return err
+	})
+	span.SetAttributes(attribute.Int("maps.links", len(nlpLinks)))
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	// for links returned now lookup full gesdi blocks
+	nlps := []Alignment{}
+	for _, link := range nlpLinks {
+		ref := link.NLPReference
+		results, err := ma.s.lookupNLP(ctx, ar.AlignCapability, ref, headers)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			results[i].Provenance = &Provenance{
+				Method:            ma.Name(),
+				LinkReference:     link.LinkReference,
+				NLPLinkVersion:    link.NLPLinkVersion,
+				ProviderName:      link.ProviderName,
+				ExternalReference: link.ExternalReference,
+				ItemVersion:       link.ItemVersion,
+			}
+		}
+		nlps = append(nlps, results...)
+	}
+	if len(nlpLinks) != 0 || ar.DisableFallback {
+		return nlps, nil
+	}
+
+	// failsafe, if no mapped results were found
+	// perform an inferred lookup instead
+	ma.s.logger(ctx).WithField("alignToken", ar.Token()).Info("no mapped results found, falling back to inference")
+	ma.s.observeFallback()
+	inference := ma.s.aligner("inferred")
+	if inference == nil {
+		return nlps, nil
+	}
+	results, err := inference.Align(ctx, ar)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if results[i].Provenance == nil {
+			results[i].Provenance = &Provenance{Method: inference.Name()}
+		}
+		results[i].Provenance.Fallback = true
+	}
+	return results, nil
+}
+
+//
+// aligns by passing the token to the text classifier,
+// or the local inference index, to find the best
+// matching nlp
+//
+type inferredAligner struct {
+	s *OtfAlignService
+}
+
+func (ia *inferredAligner) Name() string { return "inferred" }
+
+func (ia *inferredAligner) Align(ctx context.Context, ar *AlignRequest) ([]Alignment, error) {
+
+	tcPath := ia.s.tcAlignPath // text classifier endpoint
+
+	maxResults := ar.MaxResults
+	if maxResults <= 0 {
+		maxResults = 1
+	}
+
+	if ia.s.inference != nil {
+		_, span := ia.s.startSpan(ctx, "inference search")
+		matches := ia.s.inference.Search(ar.AlignCapability, ar.Token(), maxResults, ar.MinScore)
+		span.SetAttributes(attribute.Int("inference.matches", len(matches)))
+		span.End()
+		results := make([]Alignment, 0, len(matches))
+		for _, m := range matches {
+			a := entryAlignment(m.Entry)
+			a.Score = m.Score
+			a.Provenance = &Provenance{Method: ia.Name()}
+			results = append(results, a)
+		}
+		rankAlignments(results)
+		return results, nil
+	}
+
+	var results []Alignment
+	key := cacheKey("inferred", ar.AlignCapability, ar.Token(), strconv.Itoa(maxResults), strconv.FormatFloat(ar.MinScore, 'g', -1, 64))
+	err := ia.s.cached(key, &results, func() (err error) {
+		results, err = inferredAlignment(ctx, ia.s.classifier, ar.Token(), ar.AlignCapability, tcPath, defaultHeaders(), maxResults, ar.MinScore)
+		return err
+	})
+	for i := range results {
+		results[i].Provenance = &Provenance{Method: ia.Name()}
+	}
+
+	return results, err
+}
+
+//
+// aligns by looking up the full gesdi block for
+// a token that is already an nlp reference, in the
+// local nlp dataset or the classifier
+//
+type prescribedAligner struct {
+	s *OtfAlignService
+}
+
+func (pa *prescribedAligner) Name() string { return "prescribed" }
+
+func (pa *prescribedAligner) Align(ctx context.Context, ar *AlignRequest) ([]Alignment, error) {
+
+	results, err := pa.s.lookupNLP(ctx, ar.AlignCapability, ar.Token(), defaultHeaders())
+	for i := range results {
+		results[i].Provenance = &Provenance{Method: pa.Name()}
+	}
+
+	return results, err
+}
@@ -0,0 +1,173 @@
+//
+// the request and response types of the otf-align http
+// api, shared by the service and the go client so that
+// clients do not depend on the service itself
+//
+package api
+
+import (
+	"fmt"
+)
+
+//
+// Query paramters sent to the
+// web service.
+// Params can be provided as json payload, via form components
+// or as query params
+//
+type AlignRequest struct {
+	//
+	// method to be used for alignment one of...
+	// prescribed: results in lookup/passthrough of NLP reference
+	// mapped: maps from input token through known linkages such as Australian Curriculum to find link to NLP
+	// inferred: uses text classifier lookup to try and identify desired NLP
+	//
+	AlignMethod string `json:"alignMethod" form:"alignMethod" query:"alignMethod"`
+	//
+	// parameter to guide chosen method...
+	// prescribed: will typically be an NLP reference. Lookup may still occur to find full extent of GESDI block, or value may simply be passed through/back to user
+	// mapped: will typically be a module or node reference in the providing system, which in turn will be looked up in avialable vendor maps to find link to NLP via (for example) a common Australian Curriculum link
+	// inferred: will typically be a piece of free-form text such as a question or observation
+	//
+	AlignToken interface{} `json:"alignToken" form:"alignToken" query:"alignToken"`
+	//
+	// the general capability the alignment belogs to; the broad
+	// categories of the NPLs; Literacy & Numeracy.
+	//
+	AlignCapability string `json:"alignCapability" form:"alignCapability" query:"alignCapability"`
+	//
+	// inferred only: the max number of ranked candidates to return
+	// from the classifier, defaults to 1 (the best match only)
+	//
+	MaxResults int `json:"maxResults" form:"maxResults" query:"maxResults"`
+	//
+	// inferred only: the minimum classifier score a candidate must have
+	// to be returned, defaults to 0 (no filtering)
+	//
+	MinScore float64 `json:"minScore" form:"minScore" query:"minScore"`
+	//
+	// mapped only: if true, no inference is attempted when no mapped
+	// links are found, and an empty set of alignments is returned
+	//
+	DisableFallback bool `json:"disableFallback" form:"disableFallback" query:"disableFallback"`
+}
+
+//
+// returns the align token as a string
+// token could be any json type so is converted using
+// its default format
+//
+func (ar *AlignRequest) Token() string {
+	return fmt.Sprintf("%v", ar.AlignToken)
+}
+
+//
+// the response returned from an alignment request.
+// echoes the input parameters for completeness, and
+// identifies the service instance that processed the request
+//
+type AlignResponse struct {
+	// the GESDI blocks the token aligned to
+	Alignments []Alignment `json:"alignments"`
+	// the requested alignment method
+	AlignMethod string `json:"alignMethod"`
+	// the method that actually produced the alignments, differs from
+	// AlignMethod if a mapped alignment fell back to inference
+	EffectiveMethod string `json:"effectiveMethod"`
+	// true if the requested method found nothing and another was used
+	Fallback bool `json:"fallback"`
+	// the requested align token
+	AlignToken interface{} `json:"alignToken"`
+	// the requested general capability
+	AlignCapability string `json:"alignCapability"`
+	// the id of the service instance that handled the request
+	AlignServiceID string `json:"alignServiceID"`
+	// the name of the service instance that handled the request
+	AlignServiceName string `json:"alignServiceName"`
+}
+
+//
+// a single alignment to the NLPs, the full resolution
+// of the aligned item as a GESDI block
+// (General capability, Element, Sub-element,
+// Development level, Indicator).
+//
+// keys returned by the classifier that have no
+// corresponding field are kept in Extras.
+//
+type Alignment struct {
+	// identifier of the aligned nlp item
+	ItemID string `json:"itemID,omitempty"`
+	// text of the aligned nlp item
+	ItemText string `json:"itemText,omitempty"`
+	// development level code of the item e.g. UnT3
+	DevelopmentLevel string `json:"developmentLevel,omitempty"`
+	// general capability e.g. Literacy
+	GeneralCapability string `json:"generalCapability,omitempty"`
+	// nlp element e.g. Reading and viewing
+	Element string `json:"element,omitempty"`
+	// nlp sub-element e.g. Understanding texts
+	SubElement string `json:"subElement,omitempty"`
+	// indicator heading
+	Heading string `json:"heading,omitempty"`
+	// progression level code e.g. UnT3
+	ProgressionLevel string `json:"progressionLevel,omitempty"`
+	// indicator text
+	Indicator string `json:"indicator,omitempty"`
+	// inferred only: the score the classifier gave this match
+	Score float64 `json:"score,omitempty"`
+	// inferred only: the rank of this match, 1 being the best
+	Rank int `json:"rank,omitempty"`
+	// any other path values returned for the item
+	Extras map[string]interface{} `json:"extras,omitempty"`
+	// how this alignment was produced
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+//
+// records how an alignment was produced
+//
+type Provenance struct {
+	// the method that produced the alignment
+	Method string `json:"method"`
+	// true if the alignment came from falling back to
+	// this method because the requested method found nothing
+	Fallback bool `json:"fallback,omitempty"`
+	// mapped only: the n3w link the alignment came from
+	LinkReference  string `json:"linkReference,omitempty"`
+	NLPLinkVersion string `json:"nlpLinkVersion,omitempty"`
+	// mapped only: the provider item the token matched
+	ProviderName      string `json:"providerName,omitempty"`
+	ExternalReference string `json:"externalReference,omitempty"`
+	ItemVersion       string `json:"itemVersion,omitempty"`
+}
+
+//
+// the outcome of a single item in a batch alignment
+// request.
+// Index refers to the position of the item in the
+// submitted array, only one of Response or Error
+// will be populated.
+//
+type BatchResult struct {
+	// position of the request in the submitted batch
+	Index int `json:"index"`
+	// http status that the equivalent single /align call would have returned
+	Status int `json:"status"`
+	// the alignment response if the item succeeded
+	Response *AlignResponse `json:"response,omitempty"`
+	// the reason the item failed
+	Error string `json:"error,omitempty"`
+}
+
+//
+// the response returned from a batch alignment request
+//
+type BatchResponse struct {
+	// one result per submitted request, in request order
+	Results []BatchResult `json:"results"`
+	// the id of the service instance that handled the request
+	AlignServiceID string `json:"alignServiceID"`
+	// the name of the service instance that handled the request
+	AlignServiceName string `json:"alignServiceName"`
+}
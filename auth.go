@@ -0,0 +1,458 @@
+package otfalign
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//
+// Principal is the authenticated client making a request
+//
+type Principal struct {
+	// name of the client, used in logs
+	Name string `json:"client"`
+	//
+	// what the client may call:
+	// align:<method> e.g. align:mapped, or align:* for any method
+	// maps:admin for the alignment map endpoints
+	// admin for the /admin endpoints
+	//
+	Scopes []string `json:"scopes"`
+}
+
+//
+// returns true if the principal has been granted the scope
+//
+func (p *Principal) HasScope(scope string) bool {
+
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+		if s == "align:*" && strings.HasPrefix(scope, "align:") {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// an Authenticator identifies the client making a request
+// from the credentials it carries.
+//
+// The built-in jwt bearer token and api key authenticators
+// are enabled by their options; others can be added with
+// the Authenticators() option. Authenticators are tried in
+// turn, custom authenticators first, until one recognises
+// the request's credentials.
+//
+type Authenticator interface {
+	//
+	// returns the client making the request, or nil
+	// if the request carries no credentials of the kind
+	// this authenticator handles
+	// returns an error if the credentials are not valid
+	//
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+//
+// key for the principal held in a context
+//
+type principalKey struct{}
+
+//
+// creates the built-in authenticators from the service
+// configuration. requests are only authenticated if at
+// least one authenticator is configured
+//
+func (s *OtfAlignService) initAuth() error {
+
+	ja := &jwtAuthenticator{issuer: s.jwtIssuer, audience: s.jwtAudience}
+	if s.jwtSecret != "" {
+		ja.keys = append(ja.keys, jwtKey{alg: "HS256", key: []byte(s.jwtSecret)})
+	}
+	if s.jwtKeyFile != "" {
+		k, err := readJWTKeyFile(s.jwtKeyFile)
+		if err != nil {
+			return err
+		}
+		ja.keys = append(ja.keys, k)
+	}
+	if s.jwksFile != "" {
+		keys, err := readJWKSFile(s.jwksFile)
+		if err != nil {
+			return err
+		}
+		ja.keys = append(ja.keys, keys...)
+	}
+	if len(ja.keys) > 0 {
+		s.authenticators = append(s.authenticators, ja)
+	}
+
+	if s.apiKeyFile != "" {
+		ka, err := readAPIKeyFile(s.apiKeyFile)
+		if err != nil {
+			return err
+		}
+		s.authenticators = append(s.authenticators, ka)
+	}
+	return nil
+}
+
+//
+// identifies the client of every request, rejecting requests
+// without valid credentials with 401, and attaches the client
+// to the request context.
+// when rate limited, failed attempts count against the address
+// connecting to the service, and once its limit is used up its
+// requests are rejected with 429 before credentials are checked.
+// probes and metrics scrapes are not authenticated
+//
+func (s *OtfAlignService) authenticate() echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(s.authenticators) == 0 || quietPaths[c.Path()] {
+				return next(c)
+			}
+			req := c.Request()
+			if s.authLimiter != nil {
+				if err := s.authLimiter.Check(addressKey(req)); err != nil {
+					s.observeRateLimited("auth")
+					wait := time.Second
+					if ra, ok := err.(retryAfterError); ok {
+						wait = time.Duration(ra)
+					}
+					return tooManyRequests("too many failed authentication attempts", wait)
+				}
+			}
+			p, err := s.principal(req)
+			if err != nil {
+				if s.authLimiter != nil {
+					s.authLimiter.Allow(addressKey(req))
+				}
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="otf-align"`)
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+
+			ctx := context.WithValue(req.Context(), principalKey{}, p)
+			ctx = withLogger(ctx, s.logger(ctx).WithField("client", p.Name))
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String("client", p.Name))
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+//
+// finds the client of a request with the first
+// authenticator that recognises its credentials
+//
+func (s *OtfAlignService) principal(r *http.Request) (*Principal, error) {
+
+	for _, a := range s.authenticators {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+	return nil, errors.New("missing credentials, supply a bearer token or api key")
+}
+
+//
+// rejects requests from clients without the scope with 403
+//
+func requireScope(scope string) echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := authorize(c.Request().Context(), scope); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+//
+// checks the client the context belongs to has the scope.
+// a context with no client is always allowed: either auth is
+// disabled, or the call did not come over http (e.g. worker
+// mode), as the authenticate middleware rejects http requests
+// without a client
+//
+func authorize(ctx context.Context, scope string) error {
+
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	if !ok || p.HasScope(scope) {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("client %s does not have scope %s", p.Name, scope))
+}
+
+//
+// a key used to verify jwt signatures
+//
+type jwtKey struct {
+	// key id (kid), empty to match any token
+	id string
+	// signing method the key is used with, HS256 or RS256
+	alg string
+	// []byte for HS256, *rsa.PublicKey for RS256
+	key interface{}
+}
+
+//
+// authenticates requests with a jwt bearer token in
+// the Authorization header.
+// the client name is the token subject (sub), and its
+// scopes are read from the scope claim (space separated,
+// as for oauth2) or the scopes/scp claims (arrays)
+//
+type jwtAuthenticator struct {
+	keys []jwtKey
+	// required token issuer (iss), empty for any
+	issuer string
+	// required token audience (aud), empty for any
+	audience string
+}
+
+func (ja *jwtAuthenticator) String() string {
+
+	algs := []string{}
+	seen := map[string]bool{}
+	for _, k := range ja.keys {
+		if !seen[k.alg] {
+			algs = append(algs, k.alg)
+			seen[k.alg] = true
+		}
+	}
+	return fmt.Sprintf("jwt (%s, %d keys)", strings.Join(algs, ", "), len(ja.keys))
+}
+
+func (ja *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+
+	auth := r.Header.Get(echo.HeaderAuthorization)
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{"HS256", "RS256"}}
+	if _, err := parser.ParseWithClaims(strings.TrimSpace(auth[7:]), claims, ja.key); err != nil {
+		return nil, errors.Wrap(err, "invalid bearer token")
+	}
+	if ja.issuer != "" && !claims.VerifyIssuer(ja.issuer, true) {
+		return nil, errors.New("invalid bearer token: wrong issuer")
+	}
+	if ja.audience != "" && !claims.VerifyAudience(ja.audience, true) {
+		return nil, errors.New("invalid bearer token: wrong audience")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("invalid bearer token: no subject")
+	}
+
+	return &Principal{Name: sub, Scopes: claimScopes(claims)}, nil
+}
+
+//
+// finds the key to verify a token with, by its signing
+// method and key id.
+// a key is never used with a method other than its own
+//
+func (ja *jwtAuthenticator) key(t *jwt.Token) (interface{}, error) {
+
+	alg := t.Method.Alg()
+	kid, _ := t.Header["kid"].(string)
+	for _, k := range ja.keys {
+		if k.alg == alg && (kid == "" || k.id == "" || k.id == kid) {
+			return k.key, nil
+		}
+	}
+	return nil, errors.Errorf("no %s key with id %q", alg, kid)
+}
+
+//
+// reads the scopes granted by a token
+//
+func claimScopes(claims jwt.MapClaims) []string {
+
+	scopes := []string{}
+	for _, name := range []string{"scope", "scopes", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			scopes = append(scopes, strings.Fields(v)...)
+		case []interface{}:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	return scopes
+}
+
+//
+// reads an RS256 public key from a pem file
+//
+func readJWTKeyFile(fname string) (jwtKey, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return jwtKey{}, errors.Wrap(err, "unable to read jwt key file")
+	}
+	key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return jwtKey{}, errors.Wrapf(err, "unable to parse jwt key file %s", fname)
+	}
+	return jwtKey{alg: "RS256", key: key}, nil
+}
+
+//
+// a json web key, as held in a jwks file
+//
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// rsa modulus and exponent
+	N string `json:"n"`
+	E string `json:"e"`
+	// symmetric key
+	K string `json:"k"`
+}
+
+//
+// reads the signing keys from a json web key set file;
+// RSA keys are used for RS256 and oct keys for HS256.
+// encryption keys and keys for other algorithms are ignored
+//
+func readJWKSFile(fname string) ([]jwtKey, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read jwks file")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse jwks file %s", fname)
+	}
+
+	keys := []jwtKey{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil || len(n) == 0 {
+				return nil, errors.Errorf("jwks key %d has an invalid modulus", i)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, errors.Errorf("jwks key %d has an invalid exponent", i)
+			}
+			pub := &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+			keys = append(keys, jwtKey{id: k.Kid, alg: "RS256", key: pub})
+		case k.Kty == "oct" && (k.Alg == "" || k.Alg == "HS256"):
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, errors.Errorf("jwks key %d has an invalid secret", i)
+			}
+			keys = append(keys, jwtKey{id: k.Kid, alg: "HS256", key: secret})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("jwks file %s has no RS256 or HS256 signing keys", fname)
+	}
+	return keys, nil
+}
+
+//
+// authenticates requests with a static api key in
+// the X-API-Key header
+//
+type apiKeyAuthenticator struct {
+	// clients by the sha256 hash of their key, so keys
+	// are not compared byte by byte
+	clients map[[sha256.Size]byte]*Principal
+}
+
+func (ka *apiKeyAuthenticator) String() string {
+	return fmt.Sprintf("api keys (%d clients)", len(ka.clients))
+}
+
+func (ka *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+	p, ok := ka.clients[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+	return p, nil
+}
+
+//
+// reads api keys from a json array of clients, each
+// with a key and the scopes it grants e.g.
+// [{"client": "mathspathway", "key": "...", "scopes": ["align:mapped"]}]
+//
+func readAPIKeyFile(fname string) (*apiKeyAuthenticator, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read api key file")
+	}
+	var entries []struct {
+		Principal
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse api key file %s", fname)
+	}
+
+	ka := &apiKeyAuthenticator{clients: map[[sha256.Size]byte]*Principal{}}
+	for i, e := range entries {
+		if e.Name == "" || e.Key == "" {
+			return nil, errors.Errorf("api key %d must have a client and a key", i)
+		}
+		hash := sha256.Sum256([]byte(e.Key))
+		if _, dup := ka.clients[hash]; dup {
+			return nil, errors.Errorf("api key for client %s is used more than once", e.Name)
+		}
+		p := e.Principal
+		ka.clients[hash] = &p
+	}
+	return ka, nil
+}
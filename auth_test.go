@@ -0,0 +1,342 @@
+package otfalign
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// signs a token with the given method, key and key id
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	signed, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// writes data to a file in a temporary directory
+func writeTempFile(t *testing.T, name, data string) string {
+
+	t.Helper()
+	dir, err := ioutil.TempDir("", "otf-align-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fname := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+
+	secret := []byte("s3cret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ja := &jwtAuthenticator{
+		keys: []jwtKey{
+			{alg: "HS256", key: secret},
+			{id: "rsa-1", alg: "RS256", key: &rsaKey.PublicKey},
+		},
+		issuer:   "otf-test",
+		audience: "otf-align",
+	}
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":   "mathspathway",
+			"iss":   "otf-test",
+			"aud":   "otf-align",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "align:mapped align:inferred",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		// expected client, empty if the token is rejected
+		client string
+	}{
+		{"hs256 good signature", signToken(t, jwt.SigningMethodHS256, secret, "", claims(nil)), "mathspathway"},
+		{"hs256 bad signature", signToken(t, jwt.SigningMethodHS256, []byte("guessed"), "", claims(nil)), ""},
+		{"rs256 good signature", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", claims(nil)), "mathspathway"},
+		{"rs256 without kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "", claims(nil)), "mathspathway"},
+		{"rs256 bad signature", signToken(t, jwt.SigningMethodRS256, otherKey, "rsa-1", claims(nil)), ""},
+		{"rs256 unknown kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-2", claims(nil)), ""},
+		{"wrong alg", signToken(t, jwt.SigningMethodHS512, secret, "", claims(nil)), ""},
+		{"alg none", signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims(nil)), ""},
+		{"wrong issuer", signToken(t, jwt.SigningMethodHS256, secret, "", claims(func(c jwt.MapClaims) { c["iss"] = "elsewhere" })), ""},
+		{"wrong audience", signToken(t, jwt.SigningMethodHS256, secret, "", claims(func(c jwt.MapClaims) { c["aud"] = "otf-reader" })), ""},
+		{"expired", signToken(t, jwt.SigningMethodHS256, secret, "", claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), ""},
+		{"missing subject", signToken(t, jwt.SigningMethodHS256, secret, "", claims(func(c jwt.MapClaims) { delete(c, "sub") })), ""},
+		{"not a token", "not.a.token", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/align", nil)
+			r.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			p, err := ja.Authenticate(r)
+			switch {
+			case tt.client == "" && err == nil:
+				t.Errorf("expected token to be rejected, got client %v", p)
+			case tt.client != "" && err != nil:
+				t.Errorf("expected client %s, got error %v", tt.client, err)
+			case tt.client != "" && (p == nil || p.Name != tt.client):
+				t.Errorf("expected client %s, got %v", tt.client, p)
+			}
+		})
+	}
+
+	// requests without a bearer token are left to other authenticators
+	r := httptest.NewRequest(http.MethodPost, "/align", nil)
+	r.Header.Set("X-API-Key", "abc")
+	if p, err := ja.Authenticate(r); p != nil || err != nil {
+		t.Errorf("expected no client and no error without a bearer token, got %v, %v", p, err)
+	}
+}
+
+func TestReadJWKSFile(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	n := b64(rsaKey.N.Bytes())
+	e := b64(big.NewInt(int64(rsaKey.E)).Bytes())
+
+	tests := []struct {
+		name string
+		jwks string
+		// expected key algs in order, nil if the file is rejected
+		algs []string
+	}{
+		{"rsa and oct keys",
+			`{"keys": [{"kty": "RSA", "kid": "r1", "use": "sig", "n": "` + n + `", "e": "` + e + `"},
+				{"kty": "oct", "kid": "o1", "alg": "HS256", "k": "` + b64([]byte("s3cret")) + `"}]}`,
+			[]string{"RS256", "HS256"}},
+		{"encryption and other alg keys ignored",
+			`{"keys": [{"kty": "RSA", "use": "enc", "n": "` + n + `", "e": "` + e + `"},
+				{"kty": "RSA", "alg": "RS512", "n": "` + n + `", "e": "` + e + `"},
+				{"kty": "RSA", "alg": "RS256", "n": "` + n + `", "e": "` + e + `"}]}`,
+			[]string{"RS256"}},
+		{"no signing keys", `{"keys": [{"kty": "EC", "crv": "P-256"}]}`, nil},
+		{"invalid modulus", `{"keys": [{"kty": "RSA", "n": "!!", "e": "` + e + `"}]}`, nil},
+		{"invalid exponent", `{"keys": [{"kty": "RSA", "n": "` + n + `", "e": ""}]}`, nil},
+		{"invalid secret", `{"keys": [{"kty": "oct", "k": ""}]}`, nil},
+		{"not json", `keys`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := readJWKSFile(writeTempFile(t, "jwks.json", tt.jwks))
+			if tt.algs == nil {
+				if err == nil {
+					t.Errorf("expected jwks file to be rejected, got %d keys", len(keys))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tt.algs) {
+				t.Fatalf("expected %d keys, got %d", len(tt.algs), len(keys))
+			}
+			for i, k := range keys {
+				if k.alg != tt.algs[i] {
+					t.Errorf("key %d: expected %s, got %s", i, tt.algs[i], k.alg)
+				}
+			}
+		})
+	}
+
+	// a token signed by a key from the set verifies against it
+	keys, err := readJWKSFile(writeTempFile(t, "jwks.json",
+		`{"keys": [{"kty": "RSA", "kid": "r1", "n": "`+n+`", "e": "`+e+`"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja := &jwtAuthenticator{keys: keys}
+	r := httptest.NewRequest(http.MethodPost, "/align", nil)
+	r.Header.Set(echo.HeaderAuthorization, "Bearer "+signToken(t, jwt.SigningMethodRS256, rsaKey, "r1", jwt.MapClaims{"sub": "ops"}))
+	if p, err := ja.Authenticate(r); err != nil || p == nil || p.Name != "ops" {
+		t.Errorf("expected client ops, got %v, %v", p, err)
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+
+	ka, err := readAPIKeyFile(writeTempFile(t, "keys.json",
+		`[{"client": "mathspathway", "key": "mp-key", "scopes": ["align:mapped"]},
+		  {"client": "ops", "key": "ops-key", "scopes": ["admin"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		client string
+		err    bool
+	}{
+		{"known key", "mp-key", "mathspathway", false},
+		{"other known key", "ops-key", "ops", false},
+		{"unknown key", "guessed", "", true},
+		{"no key", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/align", nil)
+			if tt.key != "" {
+				r.Header.Set("X-API-Key", tt.key)
+			}
+			p, err := ka.Authenticate(r)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			name := ""
+			if p != nil {
+				name = p.Name
+			}
+			if name != tt.client {
+				t.Errorf("expected client %q, got %q", tt.client, name)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		`[{"client": "mathspathway"}]`,
+		`[{"key": "mp-key"}]`,
+		`[{"client": "a", "key": "same"}, {"client": "b", "key": "same"}]`,
+	} {
+		if _, err := readAPIKeyFile(writeTempFile(t, "keys.json", bad)); err == nil {
+			t.Errorf("expected api key file to be rejected: %s", bad)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+
+	mapped := &Principal{Name: "mathspathway", Scopes: []string{"align:mapped"}}
+	ops := &Principal{Name: "ops", Scopes: []string{"align:*", "admin"}}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		scope     string
+		allowed   bool
+	}{
+		{"scope granted", mapped, "align:mapped", true},
+		{"scope not granted", mapped, "align:inferred", false},
+		{"admin not granted", mapped, "admin", false},
+		{"any align method", ops, "align:inferred", true},
+		{"align wildcard is not maps admin", ops, "maps:admin", false},
+		{"no client", nil, "admin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = context.WithValue(ctx, principalKey{}, tt.principal)
+			}
+			err := authorize(ctx, tt.scope)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("expected scope %s to be allowed, got %v", tt.scope, err)
+				}
+				return
+			}
+			he, ok := err.(*echo.HTTPError)
+			if !ok || he.Code != http.StatusForbidden {
+				t.Errorf("expected 403 for scope %s, got %v", tt.scope, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+
+	ka, err := readAPIKeyFile(writeTempFile(t, "keys.json",
+		`[{"client": "mathspathway", "key": "mp-key", "scopes": ["align:mapped"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &OtfAlignService{
+		log:            logrus.NewEntry(logrus.New()),
+		authenticators: []Authenticator{ka},
+		authLimiter:    newClientLimiter(1, 2),
+	}
+	e := echo.New()
+	s.e = e
+	e.HTTPErrorHandler = s.errorHandler
+	e.Use(s.authenticate())
+	e.POST("/maps", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, requireScope("maps:admin"))
+	e.POST("/align", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	call := func(path, key string) int {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	steps := []struct {
+		name   string
+		path   string
+		key    string
+		status int
+	}{
+		{"valid key", "/align", "mp-key", http.StatusOK},
+		{"scope denied", "/maps", "mp-key", http.StatusForbidden},
+		{"no credentials", "/align", "", http.StatusUnauthorized},
+		{"unknown key", "/align", "guessed", http.StatusUnauthorized},
+		// the address has used up its burst of failures
+		{"failures rate limited", "/align", "guessed-again", http.StatusTooManyRequests},
+		{"valid key from limited address", "/align", "mp-key", http.StatusTooManyRequests},
+	}
+	for _, st := range steps {
+		if status := call(st.path, st.key); status != st.status {
+			t.Errorf("%s: expected %d, got %d", st.name, st.status, status)
+		}
+	}
+}
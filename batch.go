@@ -0,0 +1,128 @@
+package otfalign
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nsip/otf-align/api"
+)
+
+//
+// default number of batch items aligned concurrently
+// if no limit has been configured
+//
+const defaultBatchWorkers = 8
+
+//
+// default max number of items accepted in a batch
+// request if no limit has been configured
+//
+const defaultMaxBatchSize = 1000
+
+//
+// the outcome of a single item in a batch alignment
+// request, see api.BatchResult
+//
+type BatchResult = api.BatchResult
+
+//
+// the response returned from a batch alignment
+// request, see api.BatchResponse
+//
+type BatchResponse = api.BatchResponse
+
+//
+// creates the batch align method
+// requires an input of a json array of align requests, each
+// of which takes the same form as a request to /align
+//
+// every item is aligned independently, failures are reported
+// per item in the results array rather than failing the
+// whole batch.
+//
+// batches of more than s.maxBatchSize items are rejected
+// with 413 Request Entity Too Large
+//
+func (s *OtfAlignService) buildBatchAlignHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		ars := []AlignRequest{}
+		if err := c.Bind(&ars); err != nil {
+			s.logger(c.Request().Context()).WithError(err).Warn("cannot bind batch align request")
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		max := s.maxBatchSize
+		if max <= 0 {
+			max = defaultMaxBatchSize
+		}
+		if len(ars) > max {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("batch of %d items is larger than the max of %d", len(ars), max))
+		}
+
+		results := s.alignBatch(c.Request().Context(), ars)
+
+		batchResponse := &BatchResponse{
+			Results:          results,
+			AlignServiceID:   s.serviceID,
+			AlignServiceName: s.serviceName,
+		}
+
+		return c.JSON(http.StatusOK, batchResponse)
+	}
+}
+
+//
+// aligns all requests in the batch, running at most
+// s.batchWorkers alignments concurrently
+//
+// ctx: the batch request context; the request timeout
+// applies to each item individually
+//
+// returns results in the same order as the requests
+//
+func (s *OtfAlignService) alignBatch(ctx context.Context, ars []AlignRequest) []BatchResult {
+
+	workers := s.batchWorkers
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+
+	results := make([]BatchResult, len(ars))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i := range ars {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = s.alignBatchItem(ctx, i, &ars[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+//
+// aligns a single batch entry, converting any
+// error into a per-item result
+//
+func (s *OtfAlignService) alignBatchItem(ctx context.Context, index int, ar *AlignRequest) BatchResult {
+
+	ctx = withLogger(ctx, s.logger(ctx).WithField("batchIndex", index))
+	resp, err := s.align(ctx, ar)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		}
+		return BatchResult{Index: index, Status: status, Error: errorMessage(err)}
+	}
+
+	return BatchResult{Index: index, Status: http.StatusOK, Response: resp}
+}
@@ -0,0 +1,58 @@
+package otfalign
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestBatchAlignMaxBatchSize(t *testing.T) {
+
+	s, err := New(Name("test"), ID("test"), Port(1324), CacheSize(-1), LogLevel("error"),
+		MaxBatchSize(2), Aligners(stubAligner{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.maps.close()
+
+	item := `{"alignMethod": "mapped", "alignCapability": "numeracy", "alignToken": "00e6a88e"}`
+	tests := []struct {
+		name   string
+		items  int
+		status int
+	}{
+		{"within limit", 2, http.StatusOK},
+		{"over limit", 3, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := make([]string, tt.items)
+			for i := range items {
+				items[i] = item
+			}
+			r := httptest.NewRequest(http.MethodPost, "/align/batch",
+				strings.NewReader("["+strings.Join(items, ",")+"]"))
+			r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			w := httptest.NewRecorder()
+			s.e.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, w.Code, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var br BatchResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &br); err != nil {
+				t.Fatal(err)
+			}
+			if len(br.Results) != tt.items {
+				t.Errorf("expected %d results, got %d", tt.items, len(br.Results))
+			}
+		})
+	}
+}
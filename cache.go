@@ -0,0 +1,89 @@
+package otfalign
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+//
+// default number of alignment results held in memory
+// if no cache size has been configured
+//
+const defaultCacheSize = 1000
+
+//
+// builds the key used to cache alignment results,
+// parts are typically the method, capability and token
+// plus any parameters that change the result
+//
+func cacheKey(parts ...string) string {
+	return strings.Join(parts, "\x1f")
+}
+
+//
+// returns the cached result for key in out if present,
+// otherwise calls fill to populate out and caches the
+// result.
+//
+// out: pointer to the variable fill writes its result to
+// fill: performs the uncached lookup
+//
+func (s *OtfAlignService) cached(key string, out interface{}, fill func() error) error {
+
+	if s.cache == nil {
+		return fill()
+	}
+
+	if data, ok := s.cache.Get(key); ok {
+		if err := json.Unmarshal(data, out); err == nil {
+			return nil
+		}
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		s.log.WithError(err).Error("cannot marshal result for cache")
+		return nil
+	}
+	if err := s.cache.Set(key, data); err != nil {
+		s.log.WithError(err).Error("cannot write result to cache")
+	}
+
+	return nil
+}
+
+//
+// reports the cache statistics
+//
+func (s *OtfAlignService) buildCacheStatsHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		if s.cache == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "cache is not enabled")
+		}
+		return c.JSON(http.StatusOK, s.cache.Stats())
+	}
+}
+
+//
+// removes all entries from the alignment cache
+//
+func (s *OtfAlignService) buildCachePurgeHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		if s.cache == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "cache is not enabled")
+		}
+		if err := s.cache.Purge(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, "purged")
+	}
+}
@@ -0,0 +1,277 @@
+//
+// client for calling a running otf-align service from go
+// code, without hand-rolling json requests to /align
+//
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsip/otf-align/api"
+	"github.com/pkg/errors"
+)
+
+//
+// Client makes requests to a single otf-align service
+//
+type Client struct {
+	// base address of the align service e.g. http://localhost:1324
+	baseURL string
+	// http client used for all requests
+	httpClient *http.Client
+	// number of additional attempts made when a request fails
+	retries int
+	// delay before the first retry, doubled for each subsequent retry
+	retryWait time.Duration
+	// bearer token sent with each request, if any
+	token string
+	// api key sent with each request, if any
+	apiKey string
+}
+
+//
+// Error is returned when the align service responds with
+// a non-200 status, carrying the status code and the
+// message supplied by the server
+//
+type Error struct {
+	// http status code returned by the service
+	StatusCode int
+	// the message returned by the service
+	Message string
+	// how long the service asked the caller to wait before
+	// trying again (Retry-After header), 0 if not given
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("otf-align responded %d: %s", e.StatusCode, e.Message)
+}
+
+//
+// returns true if the request can usefully be tried
+// again - ie. the service or something in front of it
+// was temporarily unavailable
+//
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+//
+// create a new client for the align service running at
+// baseURL, such as http://localhost:1324
+//
+func New(baseURL string, options ...Option) (*Client, error) {
+
+	if baseURL == "" {
+		return nil, errors.New("align service base url must be provided")
+	}
+
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		retryWait:  200 * time.Millisecond,
+	}
+
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+//
+// aligns a single request, equivalent to a POST to /align
+//
+func (c *Client) Align(ctx context.Context, ar api.AlignRequest) (*api.AlignResponse, error) {
+
+	resp := &api.AlignResponse{}
+	if err := c.call(ctx, http.MethodPost, "/align", ar, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//
+// aligns a batch of requests, equivalent to a POST to /align/batch
+//
+// failures of individual items do not return an error, they are
+// reported in the Status and Error of the matching BatchResult
+//
+func (c *Client) AlignBatch(ctx context.Context, ars []api.AlignRequest) ([]api.BatchResult, error) {
+
+	resp := &api.BatchResponse{}
+	if err := c.call(ctx, http.MethodPost, "/align/batch", ars, resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+//
+// checks the align service is up
+// returns nil if the service responded successfully
+//
+func (c *Client) Health(ctx context.Context) error {
+
+	var ok string
+	return c.call(ctx, http.MethodGet, "/", nil, &ok)
+}
+
+//
+// makes the request to the service, retrying on network
+// errors and temporary failures, and decodes the json
+// response into out
+//
+func (c *Client) call(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+
+	var payload []byte
+	if in != nil {
+		var err error
+		payload, err = json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal align request")
+		}
+	}
+
+	wait := c.retryWait
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			delay := wait
+			if e, ok := err.(*Error); ok && e.RetryAfter > delay {
+				delay = e.RetryAfter
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			wait *= 2
+		}
+		err = c.do(ctx, method, path, payload, out)
+		if err == nil || !retryable(ctx, err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+//
+// performs a single request attempt
+//
+func (c *Client) do(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrap(err, "cannot read align service response")
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return &Error{
+			StatusCode: res.StatusCode,
+			Message:    errorMessage(respBytes),
+			RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+
+	if err := json.Unmarshal(respBytes, out); err != nil {
+		return errors.Wrap(err, "unable to unmarshal align service response")
+	}
+
+	return nil
+}
+
+//
+// extracts the message from an echo error response
+// ({"message":"..."}), or returns the raw body if
+// it is not in that form
+//
+func errorMessage(body []byte) string {
+
+	var em struct {
+		Message interface{} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &em); err == nil && em.Message != nil {
+		if m, ok := em.Message.(string); ok {
+			return m
+		}
+		return fmt.Sprintf("%v", em.Message)
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+//
+// parses a Retry-After header given in seconds,
+// returning 0 if it is missing or not a number
+//
+func retryAfter(v string) time.Duration {
+
+	secs, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+//
+// decides if a failed attempt should be retried
+//
+func retryable(ctx context.Context, err error) bool {
+
+	if ctx.Err() != nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *Error:
+		return e.Temporary()
+	case *url.Error:
+		// network failure making the request
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Option func(*Client) error
+
+//
+// set the overall timeout for each request attempt
+// defaults to 10 seconds.
+// the timeout is set on a copy of any client supplied
+// with HTTPClient(), which is left unchanged
+//
+func Timeout(d time.Duration) Option {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.New("timeout must be greater than zero")
+		}
+		hc := *c.httpClient
+		hc.Timeout = d
+		c.httpClient = &hc
+		return nil
+	}
+}
+
+//
+// set the number of times a request is retried
+// after a network error or a temporary failure
+// (429, 502, 503, 504) from the service.
+// defaults to 0, no retries
+//
+func Retries(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("retries cannot be negative")
+		}
+		c.retries = n
+		return nil
+	}
+}
+
+//
+// set the delay before the first retry, the delay
+// doubles for each further retry.
+// defaults to 200ms
+//
+func RetryWait(d time.Duration) Option {
+	return func(c *Client) error {
+		if d < 0 {
+			return errors.New("retry wait cannot be negative")
+		}
+		c.retryWait = d
+		return nil
+	}
+}
+
+//
+// supply the http client used to make requests, for example
+// to configure tls or a custom transport.
+// the timeout of the supplied client is used, unless
+// Timeout() is applied after this option
+//
+func HTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		if hc == nil {
+			return errors.New("http client cannot be nil")
+		}
+		c.httpClient = hc
+		return nil
+	}
+}
+
+//
+// set a jwt sent as a bearer token with each request,
+// for services that require authentication
+//
+func BearerToken(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+//
+// set an api key sent with each request, for
+// services that require authentication
+//
+func APIKey(key string) Option {
+	return func(c *Client) error {
+		c.apiKey = key
+		return nil
+	}
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTimeoutDoesNotChangeSuppliedClient(t *testing.T) {
+
+	shared := &http.Client{Timeout: time.Minute}
+	c, err := New("http://localhost:1324", HTTPClient(shared), Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared.Timeout != time.Minute {
+		t.Errorf("supplied client timeout changed to %s", shared.Timeout)
+	}
+	if c.httpClient.Timeout != 5*time.Second {
+		t.Errorf("expected client timeout of 5s, got %s", c.httpClient.Timeout)
+	}
+
+	// without Timeout the supplied client is used as is
+	c, err = New("http://localhost:1324", HTTPClient(shared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.httpClient != shared {
+		t.Error("expected the supplied client to be used")
+	}
+}
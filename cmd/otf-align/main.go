@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	otfal "github.com/nsip/otf-align"
 	"github.com/peterbourgon/ff"
@@ -12,49 +15,46 @@ import (
 
 func main() {
 
-	fs := flag.NewFlagSet("otf-reader", flag.ExitOnError)
-	var (
-		_           = fs.String("config", "", "config file (optional), json format.")
-		serviceName = fs.String("name", "", "name for this alignment service instance")
-		serviceID   = fs.String("id", "", "id for this alignment service instance, leave blank to auto-generate a unique id")
-		serviceHost = fs.String("host", "localhost", "name/address of host for this service")
-		servicePort = fs.Int("port", 0, "port to run service on, if not specified will assign an available port automatically")
-		niasHost    = fs.String("niasHost", "localhost", "host name/address of nias3 (n3w) web service")
-		niasPort    = fs.Int("niasPort", 1323, "port that nias3 web (n3w) service is running on")
-		niasToken   = fs.String("niasToken", "", "access token for nias server when making queries")
-		tcHost      = fs.String("tcHost", "localhost", "host name/address of text classification server")
-		tcPort      = fs.Int("tcPort", 1576, "port that text classification server is running on")
-	)
-
-	ff.Parse(fs, os.Args[1:],
-		ff.WithConfigFileFlag("config"),
-		ff.WithConfigFileParser(ff.JSONParser),
-		ff.WithEnvVarPrefix("OTF_ALIGN_SRVC"),
-	)
-
-	opts := []otfal.Option{
-		otfal.Name(*serviceName),
-		otfal.ID(*serviceID),
-		otfal.Host(*serviceHost),
-		otfal.Port(*servicePort),
-		otfal.NiasHost(*niasHost),
-		otfal.NiasPort(*niasPort),
-		otfal.NiasToken(*niasToken),
-		otfal.TcHost(*tcHost),
-		otfal.TcPort(*tcPort),
+	cfg, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Printf("\nCannot read otf-align configuration:\n%s\n\n", err)
+		return
 	}
 
-	srvc, err := otfal.New(opts...)
+	srvc, err := otfal.New(cfg.options...)
 	if err != nil {
 		fmt.Printf("\nCannot create otf-align service:\n%s\n\n", err)
 		return
 	}
 
+	switch cfg.mode {
+	case "service":
+	case "worker":
+		if err := srvc.StartWorker(); err != nil {
+			fmt.Printf("\nCannot start otf-align worker:\n%s\n\n", err)
+			return
+		}
+	default:
+		fmt.Printf("\nUnknown mode: %s, must be one of service|worker\n\n", cfg.mode)
+		return
+	}
+
 	srvc.PrintConfig()
 
+	// apply changes to the config file without restarting
+	if cfg.file != "" {
+		srvc.WatchConfig(cfg.file, cfg.reloadInterval, func() ([]otfal.Option, error) {
+			next, err := loadConfig(os.Args[1:], flag.ContinueOnError)
+			if err != nil {
+				return nil, err
+			}
+			return next.options, nil
+		})
+	}
+
 	// signal handler for shutdown
 	closed := make(chan struct{})
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Kill, os.Interrupt)
 	go func() {
 		<-c
@@ -70,3 +70,196 @@ func main() {
 	<-closed
 
 }
+
+//
+// the configuration read from the command line,
+// environment and config file
+//
+type config struct {
+	// the config file, empty if none
+	file string
+	// how often the config file is checked for changes
+	reloadInterval time.Duration
+	// run mode; service|worker
+	mode string
+	// options to create the service with
+	options []otfal.Option
+}
+
+//
+// reads the configuration; flags given on the command line
+// take precedence over environment variables, which take
+// precedence over the config file
+//
+func loadConfig(args []string, handling flag.ErrorHandling) (*config, error) {
+
+	fs := flag.NewFlagSet("otf-reader", handling)
+	if handling == flag.ContinueOnError {
+		// reloads report errors through the service log
+		fs.SetOutput(ioutil.Discard)
+	}
+	var (
+		configFile   = fs.String("config", "", "config file (optional), json format.")
+		reloadEvery  = fs.Duration("configReloadInterval", 10*time.Second, "how often the config file is checked for changes, which are applied without a restart; 0 to only reload on SIGHUP")
+		serviceName  = fs.String("name", "", "name for this alignment service instance")
+		serviceID    = fs.String("id", "", "id for this alignment service instance, leave blank to auto-generate a unique id")
+		serviceHost  = fs.String("host", "localhost", "name/address of host for this service")
+		servicePort  = fs.Int("port", 0, "port to run service on, if not specified will assign an available port automatically")
+		tlsCert      = fs.String("tlsCert", "", "pem file of the certificate to serve https with, leave blank to serve http (optional)")
+		tlsKey       = fs.String("tlsKey", "", "pem file of the private key of the tls certificate")
+		tlsClientCA  = fs.String("tlsClientCA", "", "pem file of CAs that client certificates must be signed by; requires clients to present a certificate (optional)")
+		niasHost     = fs.String("niasHost", "localhost", "host name/address of nias3 (n3w) web service")
+		niasPort     = fs.Int("niasPort", 1323, "port that nias3 web (n3w) service is running on")
+		niasToken    = fs.String("niasToken", "", "access token for nias server when making queries")
+		niasScheme   = fs.String("niasScheme", "http", "scheme used to call nias3 web (n3w); http|https")
+		niasURL      = fs.String("niasURL", "", "base url of nias3 web (n3w) including scheme and any path prefix, comma separated for several replicas; overrides niasScheme/niasHost/niasPort (optional)")
+		niasGQLPath  = fs.String("niasGraphQLPath", "/n3/graphql", "path of the n3w graphql endpoint, relative to the n3w base url")
+		niasPubPath  = fs.String("niasPublishPath", "/n3/publish", "path of the n3w publish endpoint, relative to the n3w base url")
+		niasCtxPath  = fs.String("niasContextPath", "/admin/newdemocontext", "path of the n3w endpoint creating the maps context, relative to the n3w base url")
+		tcHost       = fs.String("tcHost", "localhost", "host name/address of text classification server")
+		tcPort       = fs.Int("tcPort", 1576, "port that text classification server is running on")
+		tcScheme     = fs.String("tcScheme", "http", "scheme used to call the text classification server; http|https")
+		tcURL        = fs.String("tcURL", "", "base url of the text classification server including scheme and any path prefix, comma separated for several replicas; overrides tcScheme/tcHost/tcPort (optional)")
+		balance      = fs.String("upstreamBalance", "round-robin", "how calls are spread across n3w and classifier replicas; round-robin|least-loaded")
+		ejectThresh  = fs.Int("ejectThreshold", 3, "consecutive failed calls that eject an upstream replica, negative to never eject")
+		ejectTime    = fs.Duration("ejectTime", 30*time.Second, "how long an ejected upstream replica is left out")
+		tcAlignPath  = fs.String("tcAlignPath", "/align", "path of the text classifier align endpoint, relative to the classifier base url")
+		tcLookupPath = fs.String("tcLookupPath", "/lookup", "path of the text classifier lookup endpoint, relative to the classifier base url")
+		nlpFile      = fs.String("nlpFile", "", "json/xml file of the nlp progression, used to resolve nlp references without the text classifier (optional)")
+		tcFallback   = fs.Bool("classifierFallback", false, "look up nlp references not found in the nlpFile with the text classifier")
+		inference    = fs.String("inference", "classifier", "how inferred alignment is done; classifier: the text classifier, local: in-process using the nlpFile")
+		batchWorkers = fs.Int("batchWorkers", 8, "max number of alignments run concurrently for a batch request")
+		maxBatchSize = fs.Int("maxBatchSize", 1000, "max number of items accepted in a batch request")
+		mapBatchSize = fs.Int("mapBatchSize", 100, "max number of alignment map records sent to n3w in each publish call")
+		mapBackend   = fs.String("mapBackend", "n3w", "where alignment maps are held; n3w: the nias3 web server, local: an embedded store within this service")
+		mapStoreFile = fs.String("mapStoreFile", "", "local map backend: file to keep maps in, leave blank for a temporary store")
+		mapFiles     = fs.String("mapFiles", "", "local map backend: comma separated list of json/csv map files to load at startup (optional)")
+		profiles     = fs.String("providerProfiles", "", "json file of provider profiles for extracting align requests from otf-reader messages (optional)")
+		cacheSize    = fs.Int("cacheSize", 1000, "max number of alignment results cached in memory, negative value disables caching")
+		cacheTTL     = fs.Duration("cacheTTL", time.Hour, "how long alignment results are cached for")
+		cacheFile    = fs.String("cacheFile", "", "file for persistent on-disk caching of alignment results (optional)")
+		upTimeout    = fs.Duration("upstreamTimeout", 2*time.Second, "timeout for each call to n3w and the text classifier")
+		upRetries    = fs.Int("upstreamRetries", 2, "number of retries for failed calls to n3w and the text classifier, negative value disables retries")
+		upRetryDelay = fs.Duration("upstreamRetryDelay", 100*time.Millisecond, "delay before first retry of a failed upstream call, doubles on each retry")
+		upRetryMax   = fs.Duration("upstreamRetryMaxDelay", 2*time.Second, "max delay between retries of a failed upstream call")
+		upCA         = fs.String("upstreamCA", "", "pem file of additional CAs trusted for https calls to n3w and the text classifier (optional)")
+		upCert       = fs.String("upstreamCert", "", "pem file of the client certificate presented to n3w and the text classifier over https (optional)")
+		upKey        = fs.String("upstreamKey", "", "pem file of the private key of the upstream client certificate")
+		brkThreshold = fs.Int("breakerThreshold", 5, "consecutive upstream failures before its circuit breaker opens, negative value disables")
+		brkCooldown  = fs.Duration("breakerCooldown", 30*time.Second, "how long an open circuit breaker rejects calls before retrying the upstream")
+		reqTimeout   = fs.Duration("requestTimeout", 10*time.Second, "overall deadline for each alignment including all upstream calls, 0 for none")
+		rateLimit    = fs.Float64("rateLimit", 0, "requests per second allowed for each client (api key, token subject or address), 0 for no limit")
+		rateBurst    = fs.Int("rateBurst", 0, "requests a client may make in a burst above rateLimit, defaults to rateLimit")
+		maxUpCalls   = fs.Int("maxUpstreamCalls", 0, "max calls to n3w and the text classifier in flight at once, 0 for no limit")
+		logLevel     = fs.String("logLevel", "info", "min level of log entries written; debug|info|warn|error")
+		logFormat    = fs.String("logFormat", "json", "format of log entries; json|text")
+		traceExp     = fs.String("traceExporter", "none", "where trace spans are exported to; none, stdout, or otlp: an opentelemetry collector at traceEndpoint")
+		traceURL     = fs.String("traceEndpoint", "http://localhost:4318", "url of the opentelemetry collector that otlp trace spans are sent to")
+		traceRatio   = fs.Float64("traceSampleRatio", 1, "fraction of traces started by this service that are recorded, between 0 and 1")
+		jwtSecret    = fs.String("jwtSecret", "", "shared secret to verify HS256 bearer tokens; enables authentication (optional)")
+		jwtKeyFile   = fs.String("jwtKeyFile", "", "pem file of the rsa public key to verify RS256 bearer tokens; enables authentication (optional)")
+		jwksFile     = fs.String("jwksFile", "", "json web key set file of keys to verify bearer tokens; enables authentication (optional)")
+		jwtIssuer    = fs.String("jwtIssuer", "", "issuer bearer tokens must have, leave blank for any (optional)")
+		jwtAudience  = fs.String("jwtAudience", "", "audience bearer tokens must include, leave blank for any (optional)")
+		apiKeyFile   = fs.String("apiKeyFile", "", "json file of api keys with their clients and scopes; enables authentication (optional)")
+		mode         = fs.String("mode", "service", "run mode; service: serve alignment requests over http, worker: also consume otf-reader messages from nats streaming")
+		natsURL      = fs.String("natsURL", "nats://localhost:4222", "worker mode: address of the nats streaming server")
+		natsCluster  = fs.String("natsCluster", "test-cluster", "worker mode: nats streaming cluster id")
+		natsClientID = fs.String("natsClientID", "otf_align_worker", "worker mode: client id for the nats streaming connection, must be unique per worker")
+		natsDurable  = fs.String("natsDurable", "otf_align", "worker mode: durable name of the ingest subscription")
+		natsQueue    = fs.String("natsQueue", "", "worker mode: queue group to share ingest messages between workers (optional)")
+		inSubject    = fs.String("ingestSubject", "otf.ingest", "worker mode: subject to consume otf-reader messages from")
+		outSubject   = fs.String("alignedSubject", "otf.aligned", "worker mode: subject to publish aligned messages to")
+		dlSubject    = fs.String("deadLetterSubject", "otf.align.failed", "worker mode: subject to publish messages that could not be aligned to")
+		workers      = fs.Int("workerConcurrency", 8, "worker mode: max number of messages aligned concurrently")
+	)
+
+	err := ff.Parse(fs, args,
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ff.JSONParser),
+		ff.WithEnvVarPrefix("OTF_ALIGN_SRVC"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []otfal.Option{
+		otfal.Name(*serviceName),
+		otfal.ID(*serviceID),
+		otfal.Host(*serviceHost),
+		otfal.Port(*servicePort),
+		otfal.TLSCertFile(*tlsCert),
+		otfal.TLSKeyFile(*tlsKey),
+		otfal.TLSClientCAFile(*tlsClientCA),
+		otfal.NiasHost(*niasHost),
+		otfal.NiasPort(*niasPort),
+		otfal.NiasToken(*niasToken),
+		otfal.NiasScheme(*niasScheme),
+		otfal.NiasURL(strings.Split(*niasURL, ",")...),
+		otfal.NiasGraphQLPath(*niasGQLPath),
+		otfal.NiasPublishPath(*niasPubPath),
+		otfal.NiasContextPath(*niasCtxPath),
+		otfal.TcHost(*tcHost),
+		otfal.TcPort(*tcPort),
+		otfal.TcScheme(*tcScheme),
+		otfal.TcURL(strings.Split(*tcURL, ",")...),
+		otfal.UpstreamBalance(*balance),
+		otfal.EjectThreshold(*ejectThresh),
+		otfal.EjectTime(*ejectTime),
+		otfal.TcAlignPath(*tcAlignPath),
+		otfal.TcLookupPath(*tcLookupPath),
+		otfal.NLPFile(*nlpFile),
+		otfal.ClassifierFallback(*tcFallback),
+		otfal.InferenceBackend(*inference),
+		otfal.BatchWorkers(*batchWorkers),
+		otfal.MaxBatchSize(*maxBatchSize),
+		otfal.MapBatchSize(*mapBatchSize),
+		otfal.MapBackend(*mapBackend),
+		otfal.MapStoreFile(*mapStoreFile),
+		otfal.MapFiles(strings.Split(*mapFiles, ",")...),
+		otfal.ProviderProfileFile(*profiles),
+		otfal.CacheSize(*cacheSize),
+		otfal.CacheTTL(*cacheTTL),
+		otfal.CacheFile(*cacheFile),
+		otfal.UpstreamTimeout(*upTimeout),
+		otfal.UpstreamRetries(*upRetries),
+		otfal.UpstreamRetryDelay(*upRetryDelay),
+		otfal.UpstreamRetryMaxDelay(*upRetryMax),
+		otfal.UpstreamCAFile(*upCA),
+		otfal.UpstreamCertFile(*upCert),
+		otfal.UpstreamKeyFile(*upKey),
+		otfal.BreakerThreshold(*brkThreshold),
+		otfal.BreakerCooldown(*brkCooldown),
+		otfal.RequestTimeout(*reqTimeout),
+		otfal.RateLimit(*rateLimit),
+		otfal.RateBurst(*rateBurst),
+		otfal.MaxUpstreamCalls(*maxUpCalls),
+		otfal.LogLevel(*logLevel),
+		otfal.LogFormat(*logFormat),
+		otfal.TraceExporter(*traceExp),
+		otfal.TraceEndpoint(*traceURL),
+		otfal.TraceSampleRatio(*traceRatio),
+		otfal.JWTSecret(*jwtSecret),
+		otfal.JWTKeyFile(*jwtKeyFile),
+		otfal.JWKSFile(*jwksFile),
+		otfal.JWTIssuer(*jwtIssuer),
+		otfal.JWTAudience(*jwtAudience),
+		otfal.APIKeyFile(*apiKeyFile),
+		otfal.NatsURL(*natsURL),
+		otfal.NatsCluster(*natsCluster),
+		otfal.NatsClientID(*natsClientID),
+		otfal.NatsDurable(*natsDurable),
+		otfal.NatsQueue(*natsQueue),
+		otfal.IngestSubject(*inSubject),
+		otfal.AlignedSubject(*outSubject),
+		otfal.DeadLetterSubject(*dlSubject),
+		otfal.WorkerConcurrency(*workers),
+	}
+
+	return &config{
+		file:           *configFile,
+		reloadInterval: *reloadEvery,
+		mode:           *mode,
+		options:        opts,
+	}, nil
+}
@@ -0,0 +1,205 @@
+package otfalign
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nsip/otf-align/internal/util"
+	"github.com/pkg/errors"
+)
+
+//
+// the state of a single dependency of the service,
+// as reported by /readyz
+//
+type DependencyStatus struct {
+	// up|down
+	Status string `json:"status"`
+	// true if an enabled alignment method relies on the dependency
+	Required bool `json:"required"`
+	// time taken to probe the dependency
+	Latency string `json:"latency,omitempty"`
+	// time taken to probe the dependency, in milliseconds
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	// circuit breaker state, for upstream services
+	Breaker string `json:"breaker,omitempty"`
+	// why the dependency is down, or what it is if local
+	Detail string `json:"detail,omitempty"`
+	// up|down for each replica, for upstream services with several
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+}
+
+//
+// the response returned from /readyz
+//
+type ReadyResponse struct {
+	// ready if all required dependencies are up, otherwise unavailable
+	Status string `json:"status"`
+	// status of each dependency, keyed by name
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+	// the id of the service instance that handled the request
+	AlignServiceID string `json:"alignServiceID"`
+	// the name of the service instance that handled the request
+	AlignServiceName string `json:"alignServiceName"`
+}
+
+//
+// reports that the service process is alive,
+// without checking any dependencies
+//
+func (s *OtfAlignService) buildHealthHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]string{
+			"status":           "ok",
+			"alignServiceID":   s.serviceID,
+			"alignServiceName": s.serviceName,
+		})
+	}
+}
+
+//
+// reports whether the service can align, by probing
+// n3w and the classifier, and checking any local
+// backends.
+//
+// returns 503 Service Unavailable if any dependency
+// required by an enabled method is down
+//
+func (s *OtfAlignService) buildReadyHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		resp := s.ready(c.Request().Context())
+		status := http.StatusOK
+		if resp.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		return c.JSON(status, resp)
+	}
+}
+
+//
+// checks all dependencies, probing the upstream
+// services concurrently
+//
+func (s *OtfAlignService) ready(ctx context.Context) *ReadyResponse {
+
+	deps := map[string]DependencyStatus{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	probe := func(up *util.Upstream, required bool, method, path string, headers map[string]string, body []byte) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds := s.probe(ctx, up, method, path, headers, body)
+			ds.Required = required
+			mu.Lock()
+			deps[up.Name] = ds
+			mu.Unlock()
+		}()
+	}
+
+	// n3w is only needed if it holds the maps
+	_, n3wRequired := s.maps.(*n3wMaps)
+	n3wHeaders := defaultHeaders()
+	n3wHeaders["Authorization"] = s.n3wToken()
+	probe(s.n3w, n3wRequired && s.aligner("mapped") != nil, "POST",
+		s.niasGraphQLPath,
+		n3wHeaders, buildQuery("otf-align-readyz"))
+
+	// the classifier is needed for nlp lookups unless the local
+	// dataset covers them, and for inference unless local
+	lookups := s.nlp == nil || s.classifierFallback
+	tcRequired := (lookups && (s.aligner("prescribed") != nil || s.aligner("mapped") != nil)) ||
+		(s.inference == nil && s.aligner("inferred") != nil)
+	probe(s.classifier, tcRequired, "GET",
+		s.tcLookupPath+"?search=otf-align-readyz",
+		defaultHeaders(), nil)
+
+	wg.Wait()
+
+	if lm, ok := s.maps.(*localMaps); ok {
+		deps["mapStore"] = DependencyStatus{Status: "up", Required: true, Detail: lm.String()}
+	}
+	if s.nlp != nil {
+		deps["nlpDataset"] = DependencyStatus{Status: "up", Required: true, Detail: "version " + s.nlp.Version}
+	}
+	if w := s.worker; w != nil {
+		ds := DependencyStatus{Status: "up", Required: true, Detail: s.natsURL}
+		if nc := w.conn.NatsConn(); nc == nil || !nc.IsConnected() {
+			ds.Status = "down"
+		}
+		deps["nats"] = ds
+	}
+
+	resp := &ReadyResponse{
+		Status:           "ready",
+		Dependencies:     deps,
+		AlignServiceID:   s.serviceID,
+		AlignServiceName: s.serviceName,
+	}
+	for _, ds := range deps {
+		if ds.Required && ds.Status != "up" {
+			resp.Status = "unavailable"
+		}
+	}
+
+	return resp
+}
+
+//
+// makes a single call to each replica of an upstream to see
+// if it is up; the upstream is up if any replica is.
+// any response other than a server error or an auth failure
+// counts as up, as the probe only needs the service to be
+// reachable and working, not to know the probe value
+//
+func (s *OtfAlignService) probe(ctx context.Context, up *util.Upstream, method, path string, headers map[string]string, body []byte) DependencyStatus {
+
+	results := up.Probe(ctx, method, path, headers, body)
+	ds := DependencyStatus{
+		Status:  "down",
+		Breaker: up.Breaker.Status().State,
+	}
+	if len(results) > 1 {
+		ds.Endpoints = map[string]string{}
+	}
+	var firstErr error
+	for _, r := range results {
+		err := r.Err
+		if se, ok := err.(*util.StatusError); ok && se.Code < 500 {
+			switch se.Code {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				// token not accepted, calls will fail
+			default:
+				err = nil
+			}
+		}
+		status := "up"
+		if err != nil {
+			status = "down"
+			if firstErr == nil {
+				firstErr = errors.Wrap(err, r.URL)
+			}
+		}
+		if ds.Endpoints != nil {
+			ds.Endpoints[r.URL] = status
+		}
+		// report the latency of the first replica up,
+		// or of the first if none are
+		if (err == nil && ds.Status == "down") || ds.Latency == "" {
+			ds.Latency = r.Latency.Round(time.Microsecond).String()
+			ds.LatencyMs = float64(r.Latency) / float64(time.Millisecond)
+		}
+		if err == nil {
+			ds.Status = "up"
+		}
+	}
+	if ds.Status == "down" {
+		ds.Detail = firstErr.Error()
+	}
+	return ds
+}
@@ -0,0 +1,319 @@
+//
+// two-tier cache for alignment results; an in-memory
+// LRU, optionally backed by an on-disk bbolt store so
+// that results survive restarts
+//
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucket holding all cached entries in the disk tier
+var bucketName = []byte("alignments")
+
+//
+// Cache holds serialised results keyed by string.
+// Entries expire after the configured ttl in both tiers.
+//
+type Cache struct {
+	mu sync.Mutex
+	// max entries held in memory
+	size int
+	// how long an entry remains valid, 0 for no expiry
+	ttl time.Duration
+	// lru ordering, front is most recently used
+	ll *list.List
+	// lookup of key to list element
+	items map[string]*list.Element
+	// optional disk tier, nil if not configured
+	db *bolt.DB
+	// running counts of lookups
+	stats Stats
+}
+
+//
+// Stats reports the lookup results of the cache
+// since it was created
+//
+type Stats struct {
+	MemoryHits uint64 `json:"memoryHits"`
+	DiskHits   uint64 `json:"diskHits"`
+	Misses     uint64 `json:"misses"`
+	Entries    int    `json:"entries"`
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+//
+// create a new cache.
+// size: max number of entries held in memory
+// ttl: lifetime of each entry, 0 means entries never expire
+// path: file for the on-disk tier, if empty only the
+// memory tier is used
+//
+func New(size int, ttl time.Duration, path string) (*Cache, error) {
+
+	if size <= 0 {
+		return nil, errors.New("cache size must be greater than zero")
+	}
+
+	c := &Cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+
+	if path != "" {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot open cache file")
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(bucketName)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "cannot initialise cache file")
+		}
+		c.db = db
+	}
+
+	return c, nil
+}
+
+//
+// finds the value for key, checking memory first
+// then the disk tier.
+// values found on disk are promoted into memory.
+//
+// returns the value and true if found and not expired
+//
+func (c *Cache) Get(key string) ([]byte, bool) {
+
+	now := time.Now()
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		if e.expires.IsZero() || now.Before(e.expires) {
+			c.ll.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddUint64(&c.stats.MemoryHits, 1)
+			return e.value, true
+		}
+		c.removeElement(el)
+	}
+	c.mu.Unlock()
+
+	if c.db != nil {
+		if value, expires, ok := c.diskGet(key, now); ok {
+			c.mu.Lock()
+			c.add(key, value, expires)
+			c.mu.Unlock()
+			atomic.AddUint64(&c.stats.DiskHits, 1)
+			return value, true
+		}
+	}
+
+	atomic.AddUint64(&c.stats.Misses, 1)
+	return nil, false
+}
+
+//
+// stores the value for key in all tiers
+//
+func (c *Cache) Set(key string, value []byte) error {
+
+	c.mu.Lock()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	c.add(key, value, expires)
+	c.mu.Unlock()
+
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put([]byte(key), encode(value, expires))
+	})
+}
+
+//
+// removes all entries from all tiers
+//
+func (c *Cache) Purge() error {
+
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.mu.Unlock()
+
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(bucketName)
+		return err
+	})
+}
+
+//
+// changes the max entries held in memory, evicting the
+// least recently used entries if there are now too many,
+// and the lifetime of entries set from now on
+//
+func (c *Cache) SetLimits(size int, ttl time.Duration) error {
+
+	if size <= 0 {
+		return errors.New("cache size must be greater than zero")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	c.ttl = ttl
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+	return nil
+}
+
+//
+// returns the current lookup statistics
+//
+func (c *Cache) Stats() Stats {
+
+	c.mu.Lock()
+	entries := c.ll.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		MemoryHits: atomic.LoadUint64(&c.stats.MemoryHits),
+		DiskHits:   atomic.LoadUint64(&c.stats.DiskHits),
+		Misses:     atomic.LoadUint64(&c.stats.Misses),
+		Entries:    entries,
+	}
+}
+
+//
+// closes the disk tier if in use
+//
+func (c *Cache) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+//
+// adds or updates a memory entry, evicting the least
+// recently used entry if the cache is full.
+// must be called with c.mu held
+//
+func (c *Cache) add(key string, value []byte, expires time.Time) {
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&entry{key: key, value: value, expires: expires})
+	c.items[key] = el
+	for c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+//
+// must be called with c.mu held
+//
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+//
+// reads an entry from the disk tier, expired
+// entries are deleted and reported as not found
+//
+func (c *Cache) diskGet(key string, now time.Time) ([]byte, time.Time, bool) {
+
+	var value []byte
+	var expires time.Time
+	found := false
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(bucketName).Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+		v, exp := decode(raw)
+		// bolt data is only valid within the transaction
+		value = append([]byte(nil), v...)
+		expires = exp
+		found = true
+		return nil
+	})
+	if !found {
+		return nil, expires, false
+	}
+
+	if !expires.IsZero() && !now.Before(expires) {
+		_ = c.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketName).Delete([]byte(key))
+		})
+		return nil, expires, false
+	}
+
+	return value, expires, true
+}
+
+//
+// disk entries are stored as the expiry time
+// (unix nanos, 0 for none) followed by the value
+//
+func encode(value []byte, expires time.Time) []byte {
+
+	var exp int64
+	if !expires.IsZero() {
+		exp = expires.UnixNano()
+	}
+	buf := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(buf, uint64(exp))
+	copy(buf[8:], value)
+	return buf
+}
+
+func decode(raw []byte) ([]byte, time.Time) {
+
+	if len(raw) < 8 {
+		return nil, time.Unix(0, 1)
+	}
+	var expires time.Time
+	if exp := int64(binary.BigEndian.Uint64(raw)); exp != 0 {
+		expires = time.Unix(0, exp)
+	}
+	return raw[8:], expires
+}
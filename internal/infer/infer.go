@@ -0,0 +1,204 @@
+//
+// in-process text inference over the nlp progression,
+// ranking indicators against free text with bm25, as an
+// alternative to the otf-classifier
+//
+package infer
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/nsip/otf-align/internal/nlp"
+)
+
+// bm25 term frequency saturation
+const k1 = 1.2
+
+// bm25 document length normalisation
+const b = 0.75
+
+//
+// common words that carry no meaning for matching
+//
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "e": true, "eg": true, "for": true, "from": true,
+	"g": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "them": true, "they": true, "this": true, "to": true,
+	"uses": true, "use": true, "using": true, "with": true,
+}
+
+//
+// Match is an nlp entry ranked against a query
+//
+type Match struct {
+	Entry nlp.Entry
+	Score float64
+}
+
+//
+// Index ranks nlp entries against free text, with a
+// separate index for each general capability
+//
+type Index struct {
+	// index per capability, keyed by lower-case capability name
+	parts map[string]*bm25
+	// index of all entries, used for unknown capabilities
+	all *bm25
+}
+
+//
+// create an index over the given entries.
+// each entry is indexed on its indicator text, heading,
+// and sub-element name
+//
+func New(entries []nlp.Entry) *Index {
+
+	byCapability := map[string][]nlp.Entry{}
+	for _, e := range entries {
+		c := strings.ToLower(e.GeneralCapability)
+		byCapability[c] = append(byCapability[c], e)
+	}
+
+	ix := &Index{parts: map[string]*bm25{}, all: newBM25(entries)}
+	for c, es := range byCapability {
+		ix.parts[c] = newBM25(es)
+	}
+	return ix
+}
+
+//
+// ranks the entries of a capability against the text.
+// capability: general capability to search, case insensitive;
+// all entries are searched if the capability is not known
+// text: the free text to match
+// max: the max number of matches to return
+// minScore: matches scoring lower are discarded
+//
+// returns the best matches, highest score first
+//
+func (ix *Index) Search(capability, text string, max int, minScore float64) []Match {
+
+	idx, ok := ix.parts[strings.ToLower(capability)]
+	if !ok {
+		idx = ix.all
+	}
+	return idx.search(text, max, minScore)
+}
+
+//
+// bm25 index over a set of entries
+//
+type bm25 struct {
+	entries []nlp.Entry
+	// term frequencies per entry
+	tf []map[string]int
+	// length in terms of each entry
+	length []int
+	// mean entry length
+	avgLength float64
+	// number of entries containing each term
+	df map[string]int
+}
+
+func newBM25(entries []nlp.Entry) *bm25 {
+
+	idx := &bm25{
+		entries: entries,
+		tf:      make([]map[string]int, len(entries)),
+		length:  make([]int, len(entries)),
+		df:      map[string]int{},
+	}
+	total := 0
+	for i, e := range entries {
+		terms := tokenize(strings.Join([]string{e.Indicator, e.Heading, e.SubElement}, " "))
+		tf := map[string]int{}
+		for _, t := range terms {
+			tf[t]++
+		}
+		for t := range tf {
+			idx.df[t]++
+		}
+		idx.tf[i] = tf
+		idx.length[i] = len(terms)
+		total += len(terms)
+	}
+	if len(entries) > 0 {
+		idx.avgLength = float64(total) / float64(len(entries))
+	}
+	return idx
+}
+
+func (idx *bm25) search(text string, max int, minScore float64) []Match {
+
+	query := map[string]bool{}
+	for _, t := range tokenize(text) {
+		query[t] = true
+	}
+
+	n := float64(len(idx.entries))
+	matches := []Match{}
+	for i := range idx.entries {
+		score := 0.0
+		for t := range query {
+			f := float64(idx.tf[i][t])
+			if f == 0 {
+				continue
+			}
+			df := float64(idx.df[t])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := k1 * (1 - b + b*float64(idx.length[i])/idx.avgLength)
+			score += idf * f * (k1 + 1) / (f + norm)
+		}
+		if score <= 0 || score < minScore {
+			continue
+		}
+		matches = append(matches, Match{Entry: idx.entries[i], Score: score})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if max > 0 && len(matches) > max {
+		matches = matches[:max]
+	}
+	return matches
+}
+
+//
+// splits text into lower-case terms, dropping stop words
+// and reducing simple plurals to their singular form
+//
+func tokenize(text string) []string {
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if stopWords[w] {
+			continue
+		}
+		terms = append(terms, stem(w))
+	}
+	return terms
+}
+
+//
+// a deliberately light stemmer, enough to match
+// e.g. "fractions" with "fraction"
+//
+func stem(w string) string {
+
+	switch {
+	case len(w) > 4 && strings.HasSuffix(w, "ies"):
+		return w[:len(w)-3] + "y"
+	case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss"):
+		return w[:len(w)-1]
+	}
+	return w
+}
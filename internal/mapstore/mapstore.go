@@ -0,0 +1,251 @@
+//
+// embedded store for alignment map records, held in
+// bbolt, supporting the value-based graph traversal
+// that mapped alignment otherwise gets from n3w
+//
+package mapstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucket indexing every record by each of its field values
+var valuesBucket = []byte("values")
+
+// separates the parts of a values index key
+const sep = "\x1f"
+
+//
+// Record is a single map record, such as an
+// OtfProviderItem or an OtfNLPLink
+//
+type Record struct {
+	// the record type e.g. OtfNLPLink
+	Type string
+	// the record fields, single values only
+	Fields map[string]interface{}
+}
+
+//
+// Store holds map records, one bucket per record type,
+// along with an index of the records containing each value
+//
+type Store struct {
+	db *bolt.DB
+	// file to remove on close, if the store is temporary
+	temp string
+}
+
+//
+// open (or create) a store.
+// path: the bbolt file to use, if empty a temporary
+// store is created that is removed on close
+//
+func Open(path string) (*Store, error) {
+
+	s := &Store{}
+	if path == "" {
+		f, err := ioutil.TempFile("", "otf-maps-*.db")
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create temporary map store")
+		}
+		f.Close()
+		path = f.Name()
+		s.temp = path
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open map store")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(valuesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot initialise map store")
+	}
+	s.db = db
+
+	return s, nil
+}
+
+//
+// adds records to the store in a single transaction.
+// records are identified by their content, so adding
+// the same record again has no effect
+//
+func (s *Store) Put(records []Record) error {
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		values := tx.Bucket(valuesBucket)
+		for _, r := range records {
+			if r.Type == "" {
+				return errors.New("map record has no type")
+			}
+			data, err := json.Marshal(r.Fields)
+			if err != nil {
+				return errors.Wrap(err, "cannot encode map record")
+			}
+			id := recordID(r.Type, data)
+			b, err := tx.CreateBucketIfNotExists([]byte(r.Type))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(id, data); err != nil {
+				return err
+			}
+			for _, v := range r.Fields {
+				if err := values.Put(valueKey(r.Type, fmt.Sprintf("%v", v), id), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//
+// follows a traversal through the stored records, in the
+// same way as an n3w traversalWithValue query:
+// the records of the first type containing value are found,
+// then the records of each following type whose join field
+// has the same value as the join field of a record found at
+// the step before.
+//
+// returns the records found for each type in the traversal,
+// keyed by type; a type with no records has an empty list
+//
+func (s *Store) Traverse(value, join string, traversal ...string) (map[string][]map[string]interface{}, error) {
+
+	result := make(map[string][]map[string]interface{}, len(traversal))
+	for _, t := range traversal {
+		result[t] = []map[string]interface{}{}
+	}
+	if len(traversal) == 0 {
+		return result, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		values := tx.Bucket(valuesBucket)
+		matches := []string{value}
+		for step, t := range traversal {
+			b := tx.Bucket([]byte(t))
+			if b == nil {
+				return nil
+			}
+			// find the records of this type containing any matched value
+			ids := map[string]bool{}
+			for _, v := range matches {
+				prefix := valueKey(t, v, nil)
+				c := values.Cursor()
+				for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+					ids[string(k[len(prefix):])] = true
+				}
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+
+			// after the first step only records holding a matched
+			// value in their join field are followed, and their join
+			// values lead to the next step
+			joined := map[string]bool{}
+			for _, v := range matches {
+				joined[v] = true
+			}
+			next := map[string]bool{}
+			for _, id := range sortedKeys(ids) {
+				var fields map[string]interface{}
+				if err := json.Unmarshal(b.Get([]byte(id)), &fields); err != nil {
+					return errors.Wrapf(err, "cannot decode %s record", t)
+				}
+				jv, ok := fields[join]
+				if step > 0 && (!ok || !joined[fmt.Sprintf("%v", jv)]) {
+					continue
+				}
+				result[t] = append(result[t], fields)
+				if ok {
+					next[fmt.Sprintf("%v", jv)] = true
+				}
+			}
+			if len(next) == 0 {
+				return nil
+			}
+			matches = sortedKeys(next)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+//
+// returns the number of records held of each type
+//
+func (s *Store) Counts() (map[string]int, error) {
+
+	counts := map[string]int{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bytes.Equal(name, valuesBucket) {
+				return nil
+			}
+			counts[string(name)] = b.Stats().KeyN
+			return nil
+		})
+	})
+	return counts, err
+}
+
+//
+// closes the store, removing it if temporary
+//
+func (s *Store) Close() error {
+
+	err := s.db.Close()
+	if s.temp != "" {
+		os.Remove(s.temp)
+	}
+	return err
+}
+
+//
+// identifies a record by its type and content
+//
+func recordID(recordType string, data []byte) []byte {
+
+	h := sha1.Sum(append([]byte(recordType+sep), data...))
+	return []byte(hex.EncodeToString(h[:]))
+}
+
+//
+// index key for a record containing value
+//
+func valueKey(recordType, value string, id []byte) []byte {
+
+	k := []byte(value + sep + recordType + sep)
+	return append(k, id...)
+}
+
+func sortedKeys(m map[string]bool) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,67 @@
+package mapstore
+
+import (
+	"testing"
+)
+
+func TestTraverseJoinsOnJoinFieldOnly(t *testing.T) {
+
+	s, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the two provider items and two nlp links share a version
+	// value and a provider name, but only MOD1 and NLP-A share
+	// a linkReference
+	err = s.Put([]Record{
+		{Type: "OtfProviderItem", Fields: map[string]interface{}{
+			"providerName": "MathsPathway", "externalReference": "MOD1",
+			"linkReference": "LINK-A", "itemVersion": "1"}},
+		{Type: "OtfProviderItem", Fields: map[string]interface{}{
+			"providerName": "MathsPathway", "externalReference": "MOD2",
+			"linkReference": "LINK-B", "itemVersion": "1"}},
+		{Type: "OtfNLPLink", Fields: map[string]interface{}{
+			"linkReference": "LINK-A", "nlpReference": "NLP-A", "nlpLinkVersion": "1"}},
+		{Type: "OtfNLPLink", Fields: map[string]interface{}{
+			"linkReference": "LINK-B", "nlpReference": "NLP-B", "nlpLinkVersion": "1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Traverse("MOD1", "linkReference", "OtfProviderItem", "OtfNLPLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := result["OtfProviderItem"]; len(items) != 1 || items[0]["externalReference"] != "MOD1" {
+		t.Errorf("expected provider item MOD1, got %v", items)
+	}
+	if links := result["OtfNLPLink"]; len(links) != 1 || links[0]["nlpReference"] != "NLP-A" {
+		t.Errorf("expected nlp link NLP-A, got %v", links)
+	}
+
+	// a provider name is not a join value, so matching it
+	// finds the provider's items but follows only their links
+	result, err = s.Traverse("MathsPathway", "linkReference", "OtfProviderItem", "OtfNLPLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := result["OtfProviderItem"]; len(items) != 2 {
+		t.Errorf("expected 2 provider items, got %v", items)
+	}
+	if links := result["OtfNLPLink"]; len(links) != 2 {
+		t.Errorf("expected 2 nlp links, got %v", links)
+	}
+
+	// a value held by nlp links but not provider items
+	// finds nothing
+	result, err = s.Traverse("NLP-A", "linkReference", "OtfProviderItem", "OtfNLPLink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result["OtfProviderItem"]) != 0 || len(result["OtfNLPLink"]) != 0 {
+		t.Errorf("expected no records, got %v", result)
+	}
+}
@@ -0,0 +1,193 @@
+//
+// the National Literacy and Numeracy Learning Progressions
+// (nlp) held in memory, loaded from a json or xml file, so
+// nlp references can be resolved without the classifier
+//
+package nlp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//
+// Progression is the root of an nlp dataset file,
+// holding capabilities, elements, sub-elements, levels
+// and indicators in a hierarchy; in json as nested
+// arrays, in xml as nested elements with the names
+// and codes as attributes
+//
+// json:
+//	{"version": "3", "capabilities": [{"name": "Literacy", "elements": [...]}]}
+// xml:
+//	<progression version="3"><capability name="Literacy"><element ...>
+//
+type Progression struct {
+	XMLName      xml.Name     `json:"-" xml:"progression"`
+	Version      string       `json:"version" xml:"version,attr"`
+	Capabilities []Capability `json:"capabilities" xml:"capability"`
+}
+
+// Capability is a general capability e.g. Literacy
+type Capability struct {
+	Name     string    `json:"name" xml:"name,attr"`
+	Elements []Element `json:"elements" xml:"element"`
+}
+
+// Element e.g. Reading and viewing
+type Element struct {
+	Name        string       `json:"name" xml:"name,attr"`
+	SubElements []SubElement `json:"subElements" xml:"subElement"`
+}
+
+// SubElement e.g. Understanding texts
+type SubElement struct {
+	Name   string  `json:"name" xml:"name,attr"`
+	Levels []Level `json:"levels" xml:"level"`
+}
+
+// Level is a development level of a sub-element e.g. UnT3
+type Level struct {
+	Code       string      `json:"code" xml:"code,attr"`
+	Heading    string      `json:"heading" xml:"heading,attr"`
+	Indicators []Indicator `json:"indicators" xml:"indicator"`
+}
+
+// Indicator is a single indicator of a development level
+type Indicator struct {
+	ID   string `json:"id" xml:"id,attr"`
+	Text string `json:"text" xml:",chardata"`
+}
+
+//
+// Entry is the full resolution of an nlp reference,
+// from general capability down to indicator.
+// entries for a development level have no indicator
+//
+type Entry struct {
+	ItemID            string
+	ItemText          string
+	GeneralCapability string
+	Element           string
+	SubElement        string
+	DevelopmentLevel  string
+	Heading           string
+	Indicator         string
+}
+
+//
+// Dataset is a loaded nlp progression, indexed for lookup
+//
+type Dataset struct {
+	// version of the progression
+	Version string
+	// one entry per indicator, in file order
+	entries []Entry
+	// indicator entries by indicator id
+	byID map[string]int
+	// development level entries by level code
+	byLevel map[string]Entry
+}
+
+//
+// loads the dataset from file, read as xml if the file
+// has an .xml extension, otherwise as json
+//
+func Load(path string) (*Dataset, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read nlp file")
+	}
+
+	var p Progression
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		err = xml.Unmarshal(data, &p)
+	} else {
+		err = json.Unmarshal(data, &p)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse nlp file %s", path)
+	}
+
+	return New(&p)
+}
+
+//
+// indexes a progression for lookup.
+// indicator ids and level codes must be unique
+//
+func New(p *Progression) (*Dataset, error) {
+
+	d := &Dataset{
+		Version: p.Version,
+		byID:    map[string]int{},
+		byLevel: map[string]Entry{},
+	}
+	for _, c := range p.Capabilities {
+		for _, e := range c.Elements {
+			for _, se := range e.SubElements {
+				for _, l := range se.Levels {
+					level := Entry{
+						GeneralCapability: c.Name,
+						Element:           e.Name,
+						SubElement:        se.Name,
+						DevelopmentLevel:  l.Code,
+						Heading:           l.Heading,
+					}
+					if l.Code != "" {
+						if _, dup := d.byLevel[l.Code]; dup {
+							return nil, errors.Errorf("nlp level %s appears more than once", l.Code)
+						}
+						d.byLevel[l.Code] = level
+					}
+					for _, ind := range l.Indicators {
+						if ind.ID == "" {
+							return nil, errors.Errorf("nlp level %s has an indicator with no id", l.Code)
+						}
+						if _, dup := d.byID[ind.ID]; dup {
+							return nil, errors.Errorf("nlp indicator %s appears more than once", ind.ID)
+						}
+						entry := level
+						entry.ItemID = ind.ID
+						entry.ItemText = strings.TrimSpace(ind.Text)
+						entry.Indicator = entry.ItemText
+						d.byID[ind.ID] = len(d.entries)
+						d.entries = append(d.entries, entry)
+					}
+				}
+			}
+		}
+	}
+	if len(d.entries) == 0 {
+		return nil, errors.New("nlp dataset has no indicators")
+	}
+
+	return d, nil
+}
+
+//
+// resolves an nlp reference, either an indicator id
+// or a development level code.
+// returns the entry and true if found
+//
+func (d *Dataset) Lookup(ref string) (Entry, bool) {
+
+	if i, ok := d.byID[ref]; ok {
+		return d.entries[i], true
+	}
+	e, ok := d.byLevel[ref]
+	return e, ok
+}
+
+//
+// returns the entry for every indicator in the dataset
+//
+func (d *Dataset) Entries() []Entry {
+	return d.entries
+}
@@ -0,0 +1,256 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// policies for choosing which endpoint of an
+// upstream a call is sent to
+//
+const (
+	// endpoints are used in turn
+	BalanceRoundRobin = "round-robin"
+	// the endpoint with fewest calls in flight is used,
+	// in turn if several are equally loaded
+	BalanceLeastLoaded = "least-loaded"
+)
+
+//
+// Endpoint is one replica of an upstream service
+//
+type Endpoint struct {
+	// base url of the replica, including any path prefix
+	URL string
+	// calls currently in flight to the endpoint
+	inFlight int
+	// consecutive failed calls to the endpoint
+	failures int
+	// when the endpoint is next used, if it has been ejected
+	ejectedUntil time.Time
+}
+
+//
+// EndpointStatus reports the current state of an endpoint
+//
+type EndpointStatus struct {
+	URL                 string     `json:"url"`
+	InFlight            int        `json:"inFlight"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	EjectedUntil        *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+//
+// Balancer spreads calls across the endpoints of an upstream.
+// Endpoints are tracked passively: once an endpoint has failed
+// ejectAfter calls in a row it is ejected, and not used for
+// ejectFor unless every other endpoint has been ejected too.
+// When the time is up it is used again, but is ejected again
+// by its next failure until a call succeeds.
+//
+type Balancer struct {
+	mu        sync.Mutex
+	policy    string
+	endpoints []*Endpoint
+	// index of the endpoint to start the next search from
+	next int
+	// consecutive failures that eject an endpoint, 0 or less never ejects
+	ejectAfter int
+	// how long an ejected endpoint is left out
+	ejectFor time.Duration
+}
+
+//
+// create a balancer
+// urls: base urls of the upstream's endpoints, at least one
+// policy: BalanceRoundRobin or BalanceLeastLoaded, defaults
+// to round robin if empty
+// ejectAfter: consecutive failures that eject an endpoint, 0 or
+// less to never eject
+// ejectFor: how long an ejected endpoint is left out
+//
+func NewBalancer(urls []string, policy string, ejectAfter int, ejectFor time.Duration) *Balancer {
+
+	if policy == "" {
+		policy = BalanceRoundRobin
+	}
+	b := &Balancer{
+		policy:     policy,
+		ejectAfter: ejectAfter,
+		ejectFor:   ejectFor,
+	}
+	for _, u := range urls {
+		b.endpoints = append(b.endpoints, &Endpoint{URL: u})
+	}
+	return b
+}
+
+//
+// returns the number of endpoints
+//
+func (b *Balancer) Len() int {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.endpoints)
+}
+
+//
+// returns the base urls of the endpoints
+//
+func (b *Balancer) URLs() []string {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	urls := make([]string, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		urls[i] = ep.URL
+	}
+	return urls
+}
+
+//
+// replaces the endpoints and settings of the balancer.
+// endpoints whose url is unchanged keep their state, so
+// an ejected endpoint stays ejected; calls in flight to
+// removed endpoints complete normally
+//
+func (b *Balancer) Update(urls []string, policy string, ejectAfter int, ejectFor time.Duration) {
+
+	if policy == "" {
+		policy = BalanceRoundRobin
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := map[string]*Endpoint{}
+	for _, ep := range b.endpoints {
+		current[ep.URL] = ep
+	}
+	endpoints := make([]*Endpoint, 0, len(urls))
+	for _, u := range urls {
+		ep, ok := current[u]
+		if !ok {
+			ep = &Endpoint{URL: u}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	b.endpoints = endpoints
+	b.next = 0
+	b.policy = policy
+	b.ejectAfter = ejectAfter
+	b.ejectFor = ejectFor
+}
+
+//
+// chooses the endpoint for a call, which must be released
+// with Success, Failure or Abandon once the call is done.
+//
+// endpoints not yet tried for the call are preferred, then
+// endpoints that have not been ejected; if all have been
+// ejected the one due back soonest is used
+//
+func (b *Balancer) Pick(tried map[*Endpoint]bool) *Endpoint {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var best *Endpoint
+	bestIdx := 0
+	better := func(ep, than *Endpoint) bool {
+		if tried[ep] != tried[than] {
+			return !tried[ep]
+		}
+		epOut, thanOut := ep.ejectedUntil.After(now), than.ejectedUntil.After(now)
+		if epOut != thanOut {
+			return !epOut
+		}
+		if epOut {
+			return ep.ejectedUntil.Before(than.ejectedUntil)
+		}
+		return b.policy == BalanceLeastLoaded && ep.inFlight < than.inFlight
+	}
+	// search from the next endpoint in turn, so equally
+	// good endpoints are used in rotation
+	for i := range b.endpoints {
+		idx := (b.next + i) % len(b.endpoints)
+		if ep := b.endpoints[idx]; best == nil || better(ep, best) {
+			best, bestIdx = ep, idx
+		}
+	}
+	b.next = (bestIdx + 1) % len(b.endpoints)
+	best.inFlight++
+	return best
+}
+
+//
+// records a successful call to an endpoint, or one the
+// endpoint answered but rejected; restores an ejected
+// endpoint
+//
+func (b *Balancer) Success(ep *Endpoint) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ep.inFlight--
+	ep.failures = 0
+	ep.ejectedUntil = time.Time{}
+}
+
+//
+// records a failed call to an endpoint, ejecting it
+// once it has failed ejectAfter calls in a row
+//
+func (b *Balancer) Failure(ep *Endpoint) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ep.inFlight--
+	ep.failures++
+	if b.ejectAfter > 0 && ep.failures >= b.ejectAfter {
+		ep.ejectedUntil = time.Now().Add(b.ejectFor)
+	}
+}
+
+//
+// records a call abandoned by the caller before the
+// endpoint responded; its health is unchanged
+//
+func (b *Balancer) Abandon(ep *Endpoint) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ep.inFlight--
+}
+
+//
+// returns the current state of each endpoint
+//
+func (b *Balancer) Status() []EndpointStatus {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	status := make([]EndpointStatus, len(b.endpoints))
+	for i, ep := range b.endpoints {
+		status[i] = EndpointStatus{
+			URL:                 ep.URL,
+			InFlight:            ep.inFlight,
+			ConsecutiveFailures: ep.failures,
+		}
+		if ep.ejectedUntil.After(now) {
+			until := ep.ejectedUntil
+			status[i].EjectedUntil = &until
+		}
+	}
+	return status
+}
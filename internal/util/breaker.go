@@ -0,0 +1,174 @@
+package util
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//
+// returned when a call is rejected because the
+// circuit breaker for the upstream service is open
+//
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+//
+// states a breaker can be in
+//
+const (
+	// calls flow normally
+	BreakerClosed = "closed"
+	// calls are rejected immediately
+	BreakerOpen = "open"
+	// a single trial call is allowed through to test the upstream
+	BreakerHalfOpen = "half-open"
+)
+
+//
+// Breaker is a simple consecutive-failure circuit breaker.
+// After threshold consecutive failures the breaker opens and
+// rejects calls for the cooldown period, after which one trial
+// call is allowed; success closes the breaker, failure re-opens it.
+//
+type Breaker struct {
+	mu sync.Mutex
+	// consecutive failures before opening, 0 disables the breaker
+	threshold int
+	// how long the breaker stays open before a trial call
+	cooldown time.Duration
+	state    string
+	failures int
+	openedAt time.Time
+	// true while the half-open trial call is in flight
+	trial bool
+}
+
+//
+// BreakerStatus reports the current state of a breaker
+//
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+}
+
+//
+// create a new breaker
+// threshold: consecutive failures that open the breaker, 0 disables it
+// cooldown: time the breaker stays open before allowing a trial call
+//
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+//
+// checks whether a call may proceed
+// returns ErrCircuitOpen if the call should be rejected
+//
+func (b *Breaker) Allow() error {
+
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+		return nil
+	}
+
+	return nil
+}
+
+//
+// records a successful call, closing the breaker
+//
+func (b *Breaker) Success() {
+
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+//
+// records a failed call, opening the breaker once the
+// threshold is reached or if the half-open trial failed
+//
+func (b *Breaker) Failure() {
+
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+//
+// records a call that was abandoned by the caller before
+// the upstream responded; the breaker state is unchanged,
+// but a half-open breaker will allow another trial call
+//
+func (b *Breaker) Abandon() {
+
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+//
+// returns the current state of the breaker
+//
+func (b *Breaker) Status() BreakerStatus {
+
+	if b == nil || b.threshold <= 0 {
+		return BreakerStatus{State: BreakerClosed}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
@@ -0,0 +1,70 @@
+package util
+
+import "github.com/pkg/errors"
+
+//
+// returned when a call is rejected because the max
+// number of upstream calls are already in flight
+//
+var ErrTooManyCalls = errors.New("too many upstream calls in flight")
+
+//
+// Gate caps the number of calls in flight at once; a
+// single gate can be shared by several upstreams to cap
+// their combined calls. A nil gate allows every call.
+//
+type Gate struct {
+	// one entry per call in flight
+	slots chan struct{}
+}
+
+//
+// create a gate allowing up to max calls in flight,
+// returns nil (no limit) if max is 0 or less
+//
+func NewGate(max int) *Gate {
+
+	if max <= 0 {
+		return nil
+	}
+	return &Gate{slots: make(chan struct{}, max)}
+}
+
+//
+// claims a slot for a call, without waiting.
+// returns ErrTooManyCalls if no slot is free
+//
+func (g *Gate) Enter() error {
+
+	if g == nil {
+		return nil
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	default:
+		return ErrTooManyCalls
+	}
+}
+
+//
+// releases the slot claimed for a call
+//
+func (g *Gate) Leave() {
+
+	if g == nil {
+		return
+	}
+	<-g.slots
+}
+
+//
+// returns the number of calls in flight
+//
+func (g *Gate) InFlight() int {
+
+	if g == nil {
+		return 0
+	}
+	return len(g.slots)
+}
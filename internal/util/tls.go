@@ -0,0 +1,85 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+//
+// creates the tls configuration for serving https
+//
+// certFile, keyFile: pem files of the server certificate
+// (with any intermediates) and its private key
+// clientCAFile: pem file of the CAs client certificates must
+// be signed by; if given every client must present a valid
+// certificate (mutual tls), otherwise none is asked for
+//
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load tls certificate")
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pool, err := readCertPool(x509.NewCertPool(), clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+//
+// creates the tls configuration for calling https services
+//
+// caFile: pem file of additional CAs trusted to sign server
+// certificates, on top of the system CAs; can be empty
+// certFile, keyFile: pem files of the client certificate
+// presented to servers that ask for one, and its private
+// key; can be empty if no client certificate is needed
+//
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if cfg.RootCAs, err = readCertPool(pool, caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load tls client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+//
+// adds the certificates in a pem file to the pool
+//
+func readCertPool(pool *x509.CertPool, fname string) (*x509.CertPool, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read CA file")
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in CA file %s", fname)
+	}
+	return pool, nil
+}
@@ -0,0 +1,398 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//
+// StatusError is returned when an upstream service
+// responds with a non-200 status
+//
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Network call failed with response: %d", e.Code)
+}
+
+//
+// RetryPolicy controls how failed calls to an
+// upstream are retried
+//
+type RetryPolicy struct {
+	// max number of retries after the first attempt, 0 for none
+	Retries int
+	// delay before the first retry
+	BaseDelay time.Duration
+	// upper bound for the delay between retries
+	MaxDelay time.Duration
+}
+
+//
+// Upstream represents a service that otf-align calls, such
+// as n3w or otf-classifier; calls are made with the upstream's
+// retry policy and guarded by its circuit breaker
+//
+type Upstream struct {
+	// name of the upstream, used in errors
+	Name string
+	// the replicas of the upstream calls are spread across
+	Endpoints *Balancer
+	// retry policy for idempotent calls
+	Retry RetryPolicy
+	// circuit breaker protecting the upstream
+	Breaker *Breaker
+	// optional cap on calls in flight, can be shared between upstreams
+	Gate *Gate
+	// optional hook called after every attempt with the
+	// call context, upstream name, time taken and any error
+	Observer func(ctx context.Context, name string, d time.Duration, err error)
+	// optional tracer, each call is recorded as a client span
+	Tracer trace.Tracer
+	// optional propagator, used to pass the trace context
+	// of each call on to the upstream in its headers
+	Propagator propagation.TextMapPropagator
+	// client used to make calls
+	client *http.Client
+}
+
+//
+// create a new upstream
+// name: name of the upstream service e.g. n3w
+// timeout: overall timeout for each attempt
+// retry: retry policy for idempotent calls
+// breaker: circuit breaker for the upstream, can be nil
+//
+func NewUpstream(name string, timeout time.Duration, retry RetryPolicy, breaker *Breaker) *Upstream {
+	return &Upstream{
+		Name:    name,
+		Retry:   retry,
+		Breaker: breaker,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: newNetClient().Transport,
+		},
+	}
+}
+
+//
+// sets the tls configuration used for https calls to
+// the upstream, e.g. to trust a private CA or present
+// a client certificate
+//
+func (u *Upstream) SetTLSConfig(cfg *tls.Config) {
+
+	t := newNetClient().Transport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	u.client.Transport = t
+}
+
+//
+// Makes network calls to the upstream, and returns
+// the response payload as bytes, or an error
+//
+// ctx - cancelling the context aborts the call and any retries
+// method - http method to invoke (post/put/get etc.)
+// path - path (and query) of the request, relative to the
+// base url of the upstream's endpoints
+// header - map of headers to include in request
+// body - content to supply as request body, can be nil
+// idempotent - whether the call can safely be retried
+//
+// returns ErrCircuitOpen (wrapped) without calling the
+// upstream if its breaker is open, or ErrTooManyCalls
+// (wrapped) if its gate has no free slot
+//
+// each attempt is sent to the endpoint chosen by the balancer,
+// preferring endpoints not yet tried; if an endpoint refuses
+// the connection the attempt fails over to another straight
+// away, as the request cannot have reached the upstream
+//
+// the call, including any retries, is recorded as a span
+// if the upstream has a tracer
+//
+func (u *Upstream) Fetch(ctx context.Context, method, path string, header map[string]string, body []byte, idempotent bool) (res []byte, err error) {
+
+	ctx, span := u.startSpan(ctx, method)
+	defer func() { endSpan(span, err) }()
+	header = u.inject(ctx, header)
+
+	attempts := 1
+	if idempotent {
+		attempts += u.Retry.Retries
+	}
+	tried := map[*Endpoint]bool{}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt+1)))
+			select {
+			case <-ctx.Done():
+				return nil, errors.Wrapf(ctx.Err(), "%s call abandoned", u.Name)
+			case <-time.After(u.backoff(attempt)):
+			}
+		}
+		if gerr := u.Gate.Enter(); gerr != nil {
+			return nil, errors.Wrapf(gerr, "%s not called", u.Name)
+		}
+		if berr := u.Breaker.Allow(); berr != nil {
+			u.Gate.Leave()
+			return nil, errors.Wrapf(berr, "%s unavailable", u.Name)
+		}
+
+		res, err = u.attempt(ctx, span, method, path, header, body, tried)
+		u.Gate.Leave()
+		if err == nil {
+			u.Breaker.Success()
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			// caller gave up, says nothing about the upstream
+			u.Breaker.Abandon()
+			return nil, errors.Wrapf(ctx.Err(), "%s call abandoned", u.Name)
+		}
+		if !upstreamFault(err) {
+			// the upstream is healthy, the request was rejected
+			u.Breaker.Success()
+			return nil, err
+		}
+		u.Breaker.Failure()
+	}
+
+	return nil, errors.Wrapf(err, "%s call failed after %d attempt(s)", u.Name, attempts)
+}
+
+//
+// makes one attempt at a call, at the endpoint picked by the
+// balancer, failing over to other endpoints while connections
+// are refused
+//
+func (u *Upstream) attempt(ctx context.Context, span trace.Span, method, path string, header map[string]string, body []byte, tried map[*Endpoint]bool) ([]byte, error) {
+
+	for {
+		ep := u.Endpoints.Pick(tried)
+		tried[ep] = true
+		url := ep.URL + path
+		span.SetAttributes(semconv.HTTPURL(url))
+
+		start := time.Now()
+		res, err := fetch(ctx, u.client, method, url, header, bodyReader(body))
+		if u.Observer != nil {
+			u.Observer(ctx, u.Name, time.Since(start), err)
+		}
+		switch {
+		case err == nil || (ctx.Err() == nil && !upstreamFault(err)):
+			u.Endpoints.Success(ep)
+		case ctx.Err() != nil:
+			u.Endpoints.Abandon(ep)
+		default:
+			u.Endpoints.Failure(ep)
+		}
+		// give up once as many endpoints have been tried as the
+		// balancer now has; tried can hold more than that if the
+		// endpoints were updated during the call
+		if err == nil || ctx.Err() != nil || !connectFailed(err) || len(tried) >= u.Endpoints.Len() {
+			return res, err
+		}
+		span.AddEvent("failover", trace.WithAttributes(attribute.String("endpoint", ep.URL)))
+	}
+}
+
+//
+// ProbeResult is the outcome of probing one endpoint
+//
+type ProbeResult struct {
+	// base url of the endpoint
+	URL string
+	// time the call took
+	Latency time.Duration
+	// error returned by the call, if any
+	Err error
+}
+
+//
+// makes a single call to each endpoint of the upstream
+// to check it is reachable, concurrently, without retries
+// and without affecting or being blocked by its circuit
+// breaker or the endpoints' health
+//
+// returns the outcome for each endpoint, in order
+//
+func (u *Upstream) Probe(ctx context.Context, method, path string, header map[string]string, body []byte) []ProbeResult {
+
+	results := make([]ProbeResult, u.Endpoints.Len())
+	var wg sync.WaitGroup
+	for i, base := range u.Endpoints.URLs() {
+		wg.Add(1)
+		go func(i int, base string) {
+			defer wg.Done()
+			start := time.Now()
+			_, err := fetch(ctx, u.client, method, base+path, header, bodyReader(body))
+			results[i] = ProbeResult{URL: base, Latency: time.Since(start), Err: err}
+		}(i, base)
+	}
+	wg.Wait()
+	return results
+}
+
+//
+// UpstreamStatus reports the state of an upstream's
+// circuit breaker and of each of its endpoints
+//
+type UpstreamStatus struct {
+	BreakerStatus
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+//
+// returns the current state of the upstream
+//
+func (u *Upstream) Status() UpstreamStatus {
+	return UpstreamStatus{
+		BreakerStatus: u.Breaker.Status(),
+		Endpoints:     u.Endpoints.Status(),
+	}
+}
+
+//
+// starts the client span for a call, a span that records
+// nothing if the upstream has no tracer
+//
+func (u *Upstream) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+
+	if u.Tracer == nil {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return u.Tracer.Start(ctx, u.Name+" "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("upstream", u.Name),
+			semconv.HTTPMethod(method),
+		))
+}
+
+//
+// ends the span for a call, recording any error
+//
+func endSpan(span trace.Span, err error) {
+
+	defer span.End()
+	if err == nil {
+		span.SetAttributes(semconv.HTTPStatusCode(http.StatusOK))
+		return
+	}
+	if se, ok := errors.Cause(err).(*StatusError); ok {
+		span.SetAttributes(semconv.HTTPStatusCode(se.Code))
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+//
+// returns a copy of the headers with the trace context
+// of the call added, or the headers unchanged if the
+// upstream has no propagator
+//
+func (u *Upstream) inject(ctx context.Context, header map[string]string) map[string]string {
+
+	if u.Propagator == nil {
+		return header
+	}
+	carrier := propagation.MapCarrier{}
+	for k, v := range header {
+		carrier[k] = v
+	}
+	u.Propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+//
+// exponential backoff with full jitter for the
+// given retry attempt (1 based)
+//
+func (u *Upstream) backoff(attempt int) time.Duration {
+
+	base := u.Retry.BaseDelay
+	if base <= 0 {
+		return 0
+	}
+	delay := base << uint(attempt-1)
+	if u.Retry.MaxDelay > 0 && (delay > u.Retry.MaxDelay || delay <= 0) {
+		delay = u.Retry.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+//
+// decides whether an error indicates a problem with
+// the upstream (and so is worth retrying and counts
+// against the breaker), rather than with the request
+//
+func upstreamFault(err error) bool {
+
+	if se, ok := err.(*StatusError); ok {
+		switch {
+		case se.Code == http.StatusTooManyRequests:
+			return true
+		case se.Code >= 500 && se.Code != http.StatusNotImplemented:
+			return true
+		}
+		return false
+	}
+	// network errors
+	return true
+}
+
+//
+// Temporary reports whether an error from an upstream call
+// is likely to clear if the call is made again later: the
+// upstream could not be reached, failed or was overloaded,
+// its circuit breaker is open, or too many calls were
+// already in flight
+//
+func Temporary(err error) bool {
+
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrTooManyCalls) {
+		return true
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return upstreamFault(se)
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+//
+// decides whether an error means the connection to the
+// upstream could not be made, so the request was not sent
+//
+func connectFailed(err error) bool {
+
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+func bodyReader(body []byte) io.Reader {
+	if body == nil {
+		return nil
+	}
+	return bytes.NewReader(body)
+}
@@ -1,8 +1,8 @@
 package util
 
 import (
+	"context"
 	"crypto/rand"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -82,17 +82,19 @@ func GenerateID() string {
 }
 
 //
-// Makes network calls to other services (text-class, nias), and returns
+// performs a single network call to another service
+// (text-class, nias) with the given client, and returns
 // the response payload as bytes, or an error
 //
+// ctx - cancelling the context aborts the call
 // method - http method to invoke (post/put/get etc.)
 // header - map of headers to include in request
 // body - reader for any content to supply as request body
 //
-func Fetch(method string, url string, header map[string]string, body io.Reader) ([]byte, error) {
+func fetch(ctx context.Context, client *http.Client, method string, url string, header map[string]string, body io.Reader) ([]byte, error) {
 
 	// Create request.
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -112,10 +114,11 @@ func Fetch(method string, url string, header map[string]string, body io.Reader)
 	}
 
 	// Perform the network call.
-	res, err := newNetClient().Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	// //
 	// // TODO: turn off in production
@@ -128,7 +131,7 @@ func Fetch(method string, url string, header map[string]string, body io.Reader)
 
 	// If response from network call is not 200, return error.
 	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("Network call failed with response: %d", res.StatusCode))
+		return nil, &StatusError{Code: res.StatusCode}
 	}
 
 	// return response payload as bytes
@@ -136,23 +139,13 @@ func Fetch(method string, url string, header map[string]string, body io.Reader)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot read Fetch response")
 	}
-	res.Body.Close()
 
 	return respByte, nil
 }
 
 //
-// small utility function embedded in major ops
-// to print a performance indicator.
-//
-func TimeTrack(start time.Time, name string) {
-	elapsed := time.Since(start)
-	log.Printf("%s took %s", name, elapsed.Truncate(time.Millisecond).String())
-
-}
-
-//
-// find an available tcp port
+// find an available tcp port; the port is released
+// again before returning, ready for the caller to use
 //
 func AvailablePort() (int, error) {
 
@@ -160,6 +153,7 @@ func AvailablePort() (int, error) {
 	if err != nil {
 		return 0, errors.Wrap(err, "cannot acquire a tcp port")
 	}
+	defer listener.Close()
 
 	return listener.Addr().(*net.TCPAddr).Port, nil
 
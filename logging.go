@@ -0,0 +1,160 @@
+package otfalign
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/nsip/otf-align/internal/util"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//
+// key for the request logger held in a context
+//
+type loggerKey struct{}
+
+//
+// creates the service logger from the configured
+// level and format; every entry carries the service
+// name and id
+//
+func (s *OtfAlignService) initLogging() {
+
+	l := logrus.New()
+	l.SetOutput(os.Stdout)
+	l.SetFormatter(logFormatter(s.logFormat))
+	l.SetLevel(logLevel(s.logLevel))
+
+	s.log = l.WithFields(logrus.Fields{
+		"serviceName": s.serviceName,
+		"serviceID":   s.serviceID,
+	})
+}
+
+//
+// the formatter for a log format; json unless text
+//
+func logFormatter(format string) logrus.Formatter {
+
+	if format == "text" {
+		return &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339Nano}
+	}
+	return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+}
+
+//
+// the level for a log level name; info if not valid
+//
+func logLevel(name string) logrus.Level {
+
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		return logrus.InfoLevel
+	}
+	return level
+}
+
+//
+// returns the logger for the request the context belongs
+// to, or the service logger if there is none
+//
+func (s *OtfAlignService) logger(ctx context.Context) *logrus.Entry {
+
+	if l, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return l
+	}
+	return s.log
+}
+
+//
+// returns a copy of the context carrying the logger
+//
+func withLogger(ctx context.Context, l *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+//
+// accepts the caller's X-Request-ID, or generates one,
+// and returns it in the response
+//
+func requestID() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		Generator: util.GenerateID,
+	})
+}
+
+//
+// paths polled by probes and scrapers
+//
+var quietPaths = map[string]bool{"/": true, "/healthz": true, "/readyz": true, "/metrics": true}
+
+//
+// attaches a logger carrying the request id, and the
+// trace id if the request is traced, to the request context, and logs each completed request.
+// probes and metrics scrapes are logged at debug level
+// so they do not swamp the log
+//
+func (s *OtfAlignService) requestLogger() echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			l := s.log.WithField("requestID", c.Response().Header().Get(echo.HeaderXRequestID))
+			if sc := trace.SpanContextFromContext(req.Context()); sc.IsValid() {
+				l = l.WithField("traceID", sc.TraceID().String())
+			}
+			c.SetRequest(req.WithContext(withLogger(req.Context(), l)))
+
+			if err := next(c); err != nil {
+				// write the error response now, so its status is logged
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			l = l.WithFields(logrus.Fields{
+				"httpMethod": req.Method,
+				"path":       c.Path(),
+				"status":     status,
+				"durationMs": millis(time.Since(start)),
+			})
+			switch {
+			case status >= 500:
+				l.Warn("request failed")
+			case quietPaths[c.Path()]:
+				l.Debug("request completed")
+			default:
+				l.Info("request completed")
+			}
+			return nil
+		}
+	}
+}
+
+//
+// logs each call to an upstream service with the
+// logger of the request it was made for
+//
+func (s *OtfAlignService) logUpstream(ctx context.Context, upstream string, d time.Duration, err error) {
+
+	l := s.logger(ctx).WithFields(logrus.Fields{
+		"upstream":   upstream,
+		"durationMs": millis(d),
+	})
+	if err != nil {
+		l.WithError(err).Warn("upstream call failed")
+		return
+	}
+	l.Debug("upstream call completed")
+}
+
+//
+// a duration in fractional milliseconds, for logging
+//
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
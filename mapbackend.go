@@ -0,0 +1,258 @@
+package otfalign
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nsip/otf-align/internal/mapstore"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+//
+// the route from a provider item to nlp links
+// followed for mapped alignment
+//
+var mapTraversal = []string{"OtfProviderItem", "OtfNLPLink"}
+
+//
+// the field joining each step of the map traversal
+// to the next, see mapRecordFields
+//
+const mapJoinField = "linkReference"
+
+//
+// holds the alignment maps used for mapped alignment
+//
+type mapBackend interface {
+	// describes the backend for display
+	String() string
+	// finds the nlp links for a provider token
+	links(ctx context.Context, token string) ([]NLPLink, error)
+	// adds map records to the backend
+	publish(ctx context.Context, records []MapRecord) error
+	// releases any resources held by the backend
+	close() error
+}
+
+//
+// creates the map backend selected in the service
+// configuration, loading any map files into it
+//
+func (s *OtfAlignService) initMaps() error {
+
+	switch s.mapBackend {
+	case "", "n3w":
+		if len(s.mapFiles) > 0 {
+			return errors.New("map files can only be loaded with the local map backend")
+		}
+		s.maps = &n3wMaps{s: s}
+	case "local":
+		store, err := mapstore.Open(s.mapStoreFile)
+		if err != nil {
+			return err
+		}
+		lm := &localMaps{store: store, file: s.mapStoreFile}
+		for _, fname := range s.mapFiles {
+			if err := lm.load(fname); err != nil {
+				lm.close()
+				return err
+			}
+		}
+		s.maps = lm
+	default:
+		return errors.Errorf("unknown map backend: %q, must be one of n3w|local", s.mapBackend)
+	}
+
+	return nil
+}
+
+//
+// maps held in n3w, queried over graphql
+//
+type n3wMaps struct {
+	s *OtfAlignService
+	// guards contextToken
+	mu sync.Mutex
+	// the nias token whose n3w context is known to exist,
+	// empty until the context has been created
+	contextToken string
+}
+
+func (nm *n3wMaps) String() string {
+	return fmt.Sprintf("n3w (%s)", strings.Join(nm.s.n3w.Endpoints.URLs(), ", "))
+}
+
+func (nm *n3wMaps) links(ctx context.Context, token string) ([]NLPLink, error) {
+
+	niasPath := nm.s.niasGraphQLPath // n3w endpoint
+	headers := defaultHeaders()
+	headers["Authorization"] = nm.s.n3wToken() // add n3 auth token
+
+	return mappedAlignment(ctx, nm.s.n3w, token, niasPath, headers)
+}
+
+func (nm *n3wMaps) publish(ctx context.Context, records []MapRecord) error {
+
+	nm.ensureContext(ctx)
+
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	publishPath := nm.s.niasPublishPath
+	headers := defaultHeaders()
+	headers["Authorization"] = nm.s.n3wToken()
+	// publishing is not idempotent, so is not retried
+	_, err = nm.s.n3w.Fetch(ctx, "POST", publishPath, headers, body, false)
+	return err
+}
+
+func (nm *n3wMaps) close() error { return nil }
+
+//
+// makes sure the n3w context named in the nias token
+// exists before maps are first published to it,
+// replacing the manual call to /admin/newdemocontext.
+//
+// failures are reported but not fatal, as the context
+// may already exist; the call is tried again on the
+// next publish until it succeeds, and again if the
+// token is changed by a reload
+//
+func (nm *n3wMaps) ensureContext(ctx context.Context) {
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	token := nm.s.n3wToken()
+	if nm.contextToken == token {
+		return
+	}
+
+	uname, cname, err := tokenContext(token)
+	if err != nil {
+		nm.s.logger(ctx).WithError(err).Warn("cannot create n3w maps context")
+		return
+	}
+	form := url.Values{"userName": {uname}, "contextName": {cname}}
+	ctxPath := nm.s.niasContextPath
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+	if _, err := nm.s.n3w.Fetch(ctx, "POST", ctxPath, headers, []byte(form.Encode()), false); err != nil {
+		nm.s.logger(ctx).WithError(err).Warn("cannot create n3w maps context")
+		return
+	}
+	nm.contextToken = token
+}
+
+//
+// reads the n3w user and context names from the
+// claims (uname, cname) of the nias token.
+// the token is not verified, n3w does that
+//
+func tokenContext(token string) (uname, cname string, err error) {
+
+	parts := strings.Split(strings.TrimPrefix(token, "Bearer "), ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("nias token is not a jwt")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to decode nias token")
+	}
+	uname = gjson.GetBytes(claims, "uname").String()
+	cname = gjson.GetBytes(claims, "cname").String()
+	if uname == "" || cname == "" {
+		return "", "", errors.New("nias token has no uname/cname claims")
+	}
+	return uname, cname, nil
+}
+
+//
+// maps held in an embedded store within the service,
+// so no n3w is needed
+//
+type localMaps struct {
+	store *mapstore.Store
+	// the store file, empty if the store is temporary
+	file string
+}
+
+func (lm *localMaps) String() string {
+
+	where := lm.file
+	if where == "" {
+		where = "temporary"
+	}
+	counts, err := lm.store.Counts()
+	if err != nil {
+		return fmt.Sprintf("local (%s)", where)
+	}
+	return fmt.Sprintf("local (%s, %d provider items, %d nlp links)",
+		where, counts["OtfProviderItem"], counts["OtfNLPLink"])
+}
+
+func (lm *localMaps) links(ctx context.Context, token string) ([]NLPLink, error) {
+
+	result, err := lm.store.Traverse(token, mapJoinField, mapTraversal...)
+	if err != nil {
+		return nil, err
+	}
+	// present the results as n3w would
+	res, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{"q": result},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extractN3AlignmentMatches(res), nil
+}
+
+func (lm *localMaps) publish(ctx context.Context, records []MapRecord) error {
+
+	recs := make([]mapstore.Record, 0, len(records))
+	for _, r := range records {
+		rt := r.recordType()
+		recs = append(recs, mapstore.Record{Type: rt, Fields: r[rt]})
+	}
+	return lm.store.Put(recs)
+}
+
+func (lm *localMaps) close() error { return lm.store.Close() }
+
+//
+// bulk loads the map records in a json or csv file
+// (by file extension) into the store.
+// the file is rejected if any record is invalid
+//
+func (lm *localMaps) load(fname string) error {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return errors.Wrap(err, "unable to read map file")
+	}
+	var records []MapRecord
+	if strings.EqualFold(filepath.Ext(fname), ".csv") {
+		records, err = parseMapCSV(data)
+	} else {
+		records, err = parseMapJSON(data)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to load map file %s", fname)
+	}
+	for i, r := range records {
+		if problems := validateMapRecord(r); len(problems) > 0 {
+			return errors.Errorf("map file %s record %d is invalid: %s", fname, i, strings.Join(problems, "; "))
+		}
+	}
+
+	return lm.publish(context.Background(), records)
+}
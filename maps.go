@@ -0,0 +1,369 @@
+package otfalign
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+//
+// default number of map records sent to the map
+// backend in each publish call if no size has been configured
+//
+const defaultMapBatchSize = 100
+
+//
+// max size of a maps request body, larger
+// requests are rejected
+//
+const maxMapsBodySize = 32 << 20
+
+//
+// the fields each type of alignment map record must have
+// for mapped alignment to be able to traverse it;
+// provider items and nlp links are joined on linkReference
+//
+var mapRecordFields = map[string][]string{
+	"OtfProviderItem": {"providerName", "externalReference", "linkReference"},
+	"OtfNLPLink":      {"linkReference", "nlpReference"},
+}
+
+//
+// a single alignment map record, in the form
+// accepted by n3w e.g.
+// {"OtfNLPLink": {"linkReference": "AC9M3N01", "nlpReference": "..."}}
+//
+type MapRecord map[string]map[string]interface{}
+
+//
+// returns the type of the record, empty if the record
+// does not have exactly one type
+//
+func (r MapRecord) recordType() string {
+
+	if len(r) != 1 {
+		return ""
+	}
+	for rt := range r {
+		return rt
+	}
+	return ""
+}
+
+//
+// the outcome of a single record in a maps request.
+// Index refers to the position of the record in the
+// submitted array or csv file (excluding the header)
+//
+type MapResult struct {
+	// position of the record in the submitted maps
+	Index int `json:"index"`
+	// OtfProviderItem or OtfNLPLink
+	RecordType string `json:"recordType,omitempty"`
+	// valid|invalid|published|failed
+	Status string `json:"status"`
+	// the reasons the record was not valid or not published
+	Errors []string `json:"errors,omitempty"`
+}
+
+//
+// the response returned from a maps request
+//
+type MapsResponse struct {
+	// number of records that passed validation
+	Valid int `json:"valid"`
+	// number of records that failed validation
+	Invalid int `json:"invalid"`
+	// number of records published to the map backend
+	Published int `json:"published"`
+	// number of valid records the map backend did not accept
+	Failed int `json:"failed"`
+	// one result per submitted record, in submitted order
+	Results []MapResult `json:"results"`
+	// the id of the service instance that handled the request
+	AlignServiceID string `json:"alignServiceID"`
+	// the name of the service instance that handled the request
+	AlignServiceName string `json:"alignServiceName"`
+}
+
+//
+// creates the maps ingestion method
+// accepts alignment map records as a json array (or single
+// record), or as csv with a recordType column naming the
+// record type and a column for each field.
+//
+// records are validated and the valid ones published to
+// the map backend; the outcome of every record is reported, invalid
+// records do not prevent valid ones being published
+//
+func (s *OtfAlignService) buildMapsHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		records, err := readMapRecords(c)
+		if err != nil {
+			return err
+		}
+
+		resp := s.validateMaps(records)
+		s.publishMaps(c.Request().Context(), records, resp)
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+//
+// creates the maps validation method
+// takes the same input as /maps, but only validates
+// the records without publishing them
+//
+func (s *OtfAlignService) buildMapsValidateHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		records, err := readMapRecords(c)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, s.validateMaps(records))
+	}
+}
+
+//
+// reads the map records from the request body, as
+// csv if the content type says so, otherwise as json
+//
+// returns an echo.HTTPError if the body is too large
+// or cannot be parsed
+//
+func readMapRecords(c echo.Context) ([]MapRecord, error) {
+
+	body, err := readBody(c, maxMapsBodySize)
+	if err != nil {
+		return nil, err
+	}
+	var records []MapRecord
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+		records, err = parseMapCSV(body)
+	} else {
+		records, err = parseMapJSON(body)
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return records, nil
+}
+
+//
+// parses a json array of map records, or a single record
+//
+func parseMapJSON(data []byte) ([]MapRecord, error) {
+
+	if !gjson.ValidBytes(data) {
+		return nil, errors.New("maps are not valid json")
+	}
+	raw := []json.RawMessage{}
+	if gjson.ParseBytes(data).IsArray() {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, errors.Wrap(err, "unable to read map records")
+		}
+	} else {
+		raw = append(raw, data)
+	}
+
+	// records that are not of the expected shape are left
+	// empty, to be reported as invalid by validation
+	records := make([]MapRecord, len(raw))
+	for i, r := range raw {
+		if err := json.Unmarshal(r, &records[i]); err != nil {
+			records[i] = nil
+		}
+	}
+	return records, nil
+}
+
+//
+// parses csv map records; the header row names the fields,
+// and must include a recordType column.
+// empty cells are left out of the record
+//
+func parseMapCSV(data []byte) ([]MapRecord, error) {
+
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errors.New("maps csv is empty")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read maps csv header")
+	}
+	typeCol := -1
+	for i, h := range header {
+		if strings.TrimSpace(h) == "recordType" {
+			typeCol = i
+		}
+	}
+	if typeCol < 0 {
+		return nil, errors.New("maps csv must have a recordType column")
+	}
+
+	records := []MapRecord{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read maps csv")
+		}
+		fields := map[string]interface{}{}
+		for i, val := range row {
+			if i == typeCol || i >= len(header) || val == "" {
+				continue
+			}
+			fields[strings.TrimSpace(header[i])] = val
+		}
+		rt := ""
+		if typeCol < len(row) {
+			rt = strings.TrimSpace(row[typeCol])
+		}
+		records = append(records, MapRecord{rt: fields})
+	}
+
+	return records, nil
+}
+
+//
+// validates each record, returning the results with
+// valid records marked as valid and all others invalid
+//
+func (s *OtfAlignService) validateMaps(records []MapRecord) *MapsResponse {
+
+	resp := &MapsResponse{
+		Results:          make([]MapResult, len(records)),
+		AlignServiceID:   s.serviceID,
+		AlignServiceName: s.serviceName,
+	}
+	for i, r := range records {
+		res := MapResult{Index: i, RecordType: r.recordType()}
+		res.Errors = validateMapRecord(r)
+		if len(res.Errors) == 0 {
+			res.Status = "valid"
+			resp.Valid++
+		} else {
+			res.Status = "invalid"
+			resp.Invalid++
+		}
+		resp.Results[i] = res
+	}
+
+	return resp
+}
+
+//
+// checks a record has a known type and all
+// the fields needed for its type.
+// returns the problems found, nil if the record is valid
+//
+func validateMapRecord(r MapRecord) []string {
+
+	rt := r.recordType()
+	if rt == "" {
+		return []string{"record must be an object with exactly one record type, OtfProviderItem or OtfNLPLink"}
+	}
+	required, ok := mapRecordFields[rt]
+	if !ok {
+		return []string{fmt.Sprintf("unknown record type %q, must be OtfProviderItem or OtfNLPLink", rt)}
+	}
+
+	var problems []string
+	fields := r[rt]
+	for _, f := range required {
+		if v, ok := fields[f].(string); !ok || strings.TrimSpace(v) == "" {
+			problems = append(problems, fmt.Sprintf("%s must have a value for %s", rt, f))
+		}
+	}
+	for f, v := range fields {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			problems = append(problems, fmt.Sprintf("field %s must be a single value", f))
+		}
+	}
+
+	return problems
+}
+
+//
+// publishes the valid records to the map backend, in batches of
+// s.mapBatchSize, updating the results with the outcome
+//
+func (s *OtfAlignService) publishMaps(ctx context.Context, records []MapRecord, resp *MapsResponse) {
+
+	if resp.Valid == 0 {
+		return
+	}
+
+	size := s.mapBatchSize
+	if size <= 0 {
+		size = defaultMapBatchSize
+	}
+	batch := make([]int, 0, size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		status, msg := "published", ""
+		if err := s.publishMapBatch(ctx, records, batch); err != nil {
+			status, msg = "failed", errorMessage(alignError(err))
+		}
+		for _, i := range batch {
+			resp.Results[i].Status = status
+			if msg != "" {
+				resp.Results[i].Errors = []string{msg}
+				resp.Failed++
+			} else {
+				resp.Published++
+			}
+		}
+		batch = batch[:0]
+	}
+	for i := range records {
+		if resp.Results[i].Status != "valid" {
+			continue
+		}
+		batch = append(batch, i)
+		if len(batch) == size {
+			flush()
+		}
+	}
+	flush()
+
+	// cached mapped alignments may no longer reflect the maps
+	if resp.Published > 0 && s.cache != nil {
+		if err := s.cache.Purge(); err != nil {
+			s.logger(ctx).WithError(err).Error("could not purge cache after publishing maps")
+		}
+	}
+}
+
+//
+// sends one batch of records to the map backend
+//
+func (s *OtfAlignService) publishMapBatch(ctx context.Context, records []MapRecord, batch []int) error {
+
+	out := make([]MapRecord, 0, len(batch))
+	for _, i := range batch {
+		out = append(out, records[i])
+	}
+	return s.maps.publish(ctx, out)
+}
@@ -0,0 +1,234 @@
+package otfalign
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//
+// prometheus metrics collected by the service,
+// exposed at /metrics
+//
+type metrics struct {
+	// registry holding all service metrics
+	registry *prometheus.Registry
+	// alignment requests by method, capability and response status
+	requests *prometheus.CounterVec
+	// alignment latency by method and capability
+	requestDuration *prometheus.HistogramVec
+	// latency of each call to an upstream service
+	upstreamDuration *prometheus.HistogramVec
+	// failed calls to an upstream service
+	upstreamErrors *prometheus.CounterVec
+	// mapped alignments that found no links and fell back to inference
+	fallbacks prometheus.Counter
+	// requests rejected with 429, by reason
+	rateLimited *prometheus.CounterVec
+	// configuration reloads, by result
+	reloads *prometheus.CounterVec
+}
+
+//
+// creates and registers the service metrics
+//
+func (s *OtfAlignService) initMetrics() {
+
+	m := &metrics{registry: prometheus.NewRegistry()}
+
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otf_align",
+		Name:      "requests_total",
+		Help:      "Alignment requests by method, capability and response status.",
+	}, []string{"method", "capability", "status"})
+
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "otf_align",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to complete an alignment.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "capability"})
+
+	m.upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "otf_align",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Time taken by each call to an upstream service (n3w, otf-classifier).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	m.upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otf_align",
+		Name:      "upstream_errors_total",
+		Help:      "Failed calls to an upstream service (n3w, otf-classifier).",
+	}, []string{"upstream"})
+
+	m.fallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "otf_align",
+		Name:      "mapped_fallbacks_total",
+		Help:      "Mapped alignments that found no nlp links and fell back to inference.",
+	})
+
+	m.rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otf_align",
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected with 429; reason is client (rate limit), auth (failed authentication attempts) or upstream (max upstream calls in flight).",
+	}, []string{"reason"})
+
+	m.reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "otf_align",
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads; result is applied or rejected.",
+	}, []string{"result"})
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.upstreamDuration,
+		m.upstreamErrors,
+		m.fallbacks,
+		m.rateLimited,
+		m.reloads,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	if s.cache != nil {
+		s.registerCacheMetrics(m.registry)
+	}
+	if s.gate != nil {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "otf_align",
+			Name:      "upstream_calls_in_flight",
+			Help:      "Calls to upstream services (n3w, otf-classifier) currently in flight.",
+		}, func() float64 { return float64(s.gate.InFlight()) }))
+	}
+
+	s.metrics = m
+}
+
+//
+// exposes the cache lookup statistics, read from
+// the cache when metrics are collected
+//
+func (s *OtfAlignService) registerCacheMetrics(reg *prometheus.Registry) {
+
+	reg.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "otf_align",
+			Name:        "cache_hits_total",
+			Help:        "Alignment cache hits by cache tier.",
+			ConstLabels: prometheus.Labels{"tier": "memory"},
+		}, func() float64 { return float64(s.cache.Stats().MemoryHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "otf_align",
+			Name:        "cache_hits_total",
+			Help:        "Alignment cache hits by cache tier.",
+			ConstLabels: prometheus.Labels{"tier": "disk"},
+		}, func() float64 { return float64(s.cache.Stats().DiskHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "otf_align",
+			Name:      "cache_misses_total",
+			Help:      "Alignment cache misses.",
+		}, func() float64 { return float64(s.cache.Stats().Misses) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "otf_align",
+			Name:      "cache_entries",
+			Help:      "Alignment results currently held in the memory cache.",
+		}, func() float64 { return float64(s.cache.Stats().Entries) }),
+	)
+}
+
+//
+// records the outcome of a single alignment
+//
+func (s *OtfAlignService) observeAlignment(ar *AlignRequest, status int, d time.Duration) {
+
+	if s.metrics == nil {
+		return
+	}
+	method, capability := s.metricLabels(ar)
+	s.metrics.requests.WithLabelValues(method, capability, strconv.Itoa(status)).Inc()
+	s.metrics.requestDuration.WithLabelValues(method, capability).Observe(d.Seconds())
+}
+
+//
+// records the outcome of a single call to an upstream
+//
+func (s *OtfAlignService) observeUpstreamCall(upstream string, d time.Duration, err error) {
+
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.upstreamDuration.WithLabelValues(upstream).Observe(d.Seconds())
+	if err != nil {
+		s.metrics.upstreamErrors.WithLabelValues(upstream).Inc()
+	}
+}
+
+//
+// records a mapped alignment falling back to inference
+//
+func (s *OtfAlignService) observeFallback() {
+
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.fallbacks.Inc()
+}
+
+//
+// records a request rejected with 429
+//
+func (s *OtfAlignService) observeRateLimited(reason string) {
+
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.rateLimited.WithLabelValues(reason).Inc()
+}
+
+//
+// records the result of a configuration reload
+//
+func (s *OtfAlignService) observeReload(result string) {
+
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.reloads.WithLabelValues(result).Inc()
+}
+
+//
+// request values are supplied by callers, so are reduced to
+// a known set before use as labels to keep the number of
+// metric series bounded
+//
+func (s *OtfAlignService) metricLabels(ar *AlignRequest) (string, string) {
+
+	method := "unknown"
+	if s.aligner(ar.AlignMethod) != nil {
+		method = ar.AlignMethod
+	}
+
+	capability := strings.ToLower(ar.AlignCapability)
+	switch capability {
+	case "literacy", "numeracy":
+	case "":
+		capability = "none"
+	default:
+		capability = "other"
+	}
+
+	return method, capability
+}
+
+//
+// serves the metrics registry in prometheus format
+//
+func (s *OtfAlignService) buildMetricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,100 @@
+package otfalign
+
+import (
+	"context"
+
+	"github.com/nsip/otf-align/internal/infer"
+	"github.com/nsip/otf-align/internal/nlp"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//
+// loads the local nlp dataset, if one is configured
+//
+func (s *OtfAlignService) initNLP() error {
+
+	if s.nlpFile == "" {
+		return nil
+	}
+	d, err := nlp.Load(s.nlpFile)
+	if err != nil {
+		return err
+	}
+	s.nlp = d
+	return nil
+}
+
+//
+// sets up the inference backend; the local backend
+// indexes the nlp dataset, so needs an nlp file
+//
+func (s *OtfAlignService) initInference() error {
+
+	switch s.inferenceBackend {
+	case "", "classifier":
+	case "local":
+		if s.nlp == nil {
+			return errors.New("local inference needs an nlp file")
+		}
+		s.inference = infer.New(s.nlp.Entries())
+	default:
+		return errors.Errorf("unknown inference backend: %q, must be one of classifier|local", s.inferenceBackend)
+	}
+	return nil
+}
+
+//
+// finds the full gesdi block for an nlp reference.
+//
+// the local nlp dataset is used if loaded; the classifier
+// is only called if there is no dataset, or the reference
+// is not in the dataset and classifier fallback is enabled.
+// classifier results are cached
+//
+// returns the alignments found, empty if the
+// reference is not known
+//
+func (s *OtfAlignService) lookupNLP(ctx context.Context, capability, ref string, headers map[string]string) (results []Alignment, err error) {
+
+	ctx, span := s.startSpan(ctx, "nlp lookup", attribute.String("nlp.reference", ref))
+	defer func() { endSpan(span, err) }()
+
+	if s.nlp != nil {
+		if e, ok := s.nlp.Lookup(ref); ok {
+			span.SetAttributes(attribute.String("nlp.source", "dataset"))
+			return []Alignment{entryAlignment(e)}, nil
+		}
+		if !s.classifierFallback {
+			span.SetAttributes(attribute.String("nlp.source", "none"))
+			return []Alignment{}, nil
+		}
+	}
+	span.SetAttributes(attribute.String("nlp.source", "classifier"))
+
+	tclkpPath := s.tcLookupPath
+
+	key := cacheKey("prescribed", capability, ref)
+	err = s.cached(key, &results, func() (err error) {
+		results, err = prescribedAlignment(ctx, s.classifier, ref, tclkpPath, headers)
+		return err
+	})
+	return results, err
+}
+
+//
+// converts a local nlp dataset entry to an alignment
+//
+func entryAlignment(e nlp.Entry) Alignment {
+	return Alignment{
+		ItemID:            e.ItemID,
+		ItemText:          e.ItemText,
+		DevelopmentLevel:  e.DevelopmentLevel,
+		GeneralCapability: e.GeneralCapability,
+		Element:           e.Element,
+		SubElement:        e.SubElement,
+		Heading:           e.Heading,
+		ProgressionLevel:  e.DevelopmentLevel,
+		Indicator:         e.Indicator,
+	}
+}
@@ -1,7 +1,12 @@
 package otfalign
 
 import (
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/nsip/otf-align/internal/util"
+	"github.com/pkg/errors"
 )
 
 type Option func(*OtfAlignService) error
@@ -24,7 +29,8 @@ func (srvc *OtfAlignService) setOptions(options ...Option) error {
 // used for audit tracing purposes if multiple
 // instances of the service are active.
 // If no name provided a hashid-style unique
-// short name will be generated
+// short name will be generated, unless the
+// service already has one
 //
 func Name(name string) Option {
 	return func(s *OtfAlignService) error {
@@ -32,14 +38,17 @@ func Name(name string) Option {
 			s.serviceName = name
 			return nil
 		}
-		s.serviceName = util.GenerateName()
+		if s.serviceName == "" {
+			s.serviceName = util.GenerateName()
+		}
 		return nil
 	}
 }
 
 //
 // create a unique id for this service instance, if none
-// provided a nuid will be generated by default
+// provided a nuid will be generated by default, unless
+// the service already has one
 //
 func ID(id string) Option {
 	return func(s *OtfAlignService) error {
@@ -47,7 +56,9 @@ func ID(id string) Option {
 			s.serviceID = id
 			return nil
 		}
-		s.serviceID = util.GenerateID()
+		if s.serviceID == "" {
+			s.serviceID = util.GenerateID()
+		}
 		return nil
 	}
 }
@@ -68,7 +79,8 @@ func Host(hname string) Option {
 
 //
 // set the port to run this ersvice on.
-// if 0 then acquire avaialble port from OS
+// if 0 then acquire avaialble port from OS,
+// unless the service already has a port
 //
 func Port(port int) Option {
 	return func(s *OtfAlignService) error {
@@ -76,6 +88,9 @@ func Port(port int) Option {
 			s.servicePort = port
 			return nil
 		}
+		if s.servicePort != 0 {
+			return nil
+		}
 		osPort, err := util.AvailablePort()
 		if err != nil {
 			return err
@@ -159,3 +174,1028 @@ func TcPort(port int) Option {
 		return nil
 	}
 }
+
+//
+// set the max number of alignments performed concurrently
+// when processing a batch request.
+// defaults to 8 if no value given
+//
+func BatchWorkers(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n > 0 {
+			s.batchWorkers = n
+			return nil
+		}
+		s.batchWorkers = defaultBatchWorkers
+		return nil
+	}
+}
+
+//
+// set the max number of items accepted in a batch
+// request, larger batches are rejected.
+// defaults to 1000 if no value given
+//
+func MaxBatchSize(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n > 0 {
+			s.maxBatchSize = n
+			return nil
+		}
+		s.maxBatchSize = defaultMaxBatchSize
+		return nil
+	}
+}
+
+//
+// set the max number of alignment map records sent to
+// n3w in each publish call when ingesting maps.
+// defaults to 100 if no value given
+//
+func MapBatchSize(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n > 0 {
+			s.mapBatchSize = n
+			return nil
+		}
+		s.mapBatchSize = defaultMapBatchSize
+		return nil
+	}
+}
+
+//
+// register custom alignment methods with the service.
+// each aligner is made available at /align using its
+// Name() as the alignMethod; an aligner with the same name
+// as a built-in method (mapped|inferred|prescribed)
+// replaces the built-in
+//
+func Aligners(aligners ...Aligner) Option {
+	return func(s *OtfAlignService) error {
+		for _, a := range aligners {
+			if err := s.registerAligner(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+//
+// set the max number of alignment results held in
+// the in-memory cache.
+// defaults to 1000 if 0 given, a negative size
+// disables caching
+//
+func CacheSize(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n != 0 {
+			s.cacheSize = n
+			return nil
+		}
+		s.cacheSize = defaultCacheSize
+		return nil
+	}
+}
+
+//
+// set how long alignment results are cached for.
+// defaults to 1 hour if no value given
+//
+func CacheTTL(ttl time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if ttl > 0 {
+			s.cacheTTL = ttl
+			return nil
+		}
+		s.cacheTTL = time.Hour
+		return nil
+	}
+}
+
+//
+// set the file used for the on-disk cache tier, allowing
+// cached alignments to persist across restarts.
+// if no file given only the in-memory cache is used
+//
+func CacheFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.cacheFile = fname
+		return nil
+	}
+}
+
+//
+// set the timeout for each call made to the n3w and
+// text classifier services.
+// defaults to 2 seconds if no value given
+//
+func UpstreamTimeout(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d > 0 {
+			s.upstreamTimeout = d
+			return nil
+		}
+		s.upstreamTimeout = defaultUpstreamTimeout
+		return nil
+	}
+}
+
+//
+// set the number of times a failed call to the n3w or
+// text classifier services is retried.
+// only network errors, 429 and 5xx responses are retried.
+// defaults to 2 if 0 given, a negative value disables retries
+//
+func UpstreamRetries(n int) Option {
+	return func(s *OtfAlignService) error {
+		s.retryPolicy.Retries = n
+		return nil
+	}
+}
+
+//
+// set the delay before the first retry of an upstream
+// call; the delay doubles for each further retry and is
+// randomised (jittered) to avoid retries arriving together.
+// defaults to 100ms if no value given
+//
+func UpstreamRetryDelay(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d > 0 {
+			s.retryPolicy.BaseDelay = d
+			return nil
+		}
+		s.retryPolicy.BaseDelay = 100 * time.Millisecond
+		return nil
+	}
+}
+
+//
+// set the maximum delay between retries of an upstream call.
+// defaults to 2 seconds if no value given
+//
+func UpstreamRetryMaxDelay(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d > 0 {
+			s.retryPolicy.MaxDelay = d
+			return nil
+		}
+		s.retryPolicy.MaxDelay = 2 * time.Second
+		return nil
+	}
+}
+
+//
+// set the number of consecutive failed calls to an upstream
+// service that open its circuit breaker; while open, requests
+// needing that service fail immediately with a 503.
+// defaults to 5 if 0 given, a negative value disables the breaker
+//
+func BreakerThreshold(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n != 0 {
+			s.breakerThreshold = n
+			return nil
+		}
+		s.breakerThreshold = 5
+		return nil
+	}
+}
+
+//
+// set how long an open circuit breaker rejects calls
+// before allowing a trial call through to the upstream.
+// defaults to 30 seconds if no value given
+//
+func BreakerCooldown(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d > 0 {
+			s.breakerCooldown = d
+			return nil
+		}
+		s.breakerCooldown = 30 * time.Second
+		return nil
+	}
+}
+
+//
+// set the overall deadline for each alignment, covering
+// all upstream calls it makes (including retries and any
+// fallback to inference); when exceeded the upstream calls
+// are cancelled and a 504 is returned.
+// for batch requests the deadline applies to each item.
+// defaults to 0, no deadline
+//
+func RequestTimeout(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d < 0 {
+			return errors.New("request timeout cannot be negative")
+		}
+		s.requestTimeout = d
+		return nil
+	}
+}
+
+//
+// set the address of the nats streaming server the
+// worker consumes messages from.
+// defaults to nats://localhost:4222 if no url given
+//
+func NatsURL(url string) Option {
+	return func(s *OtfAlignService) error {
+		if url != "" {
+			s.natsURL = url
+			return nil
+		}
+		s.natsURL = "nats://localhost:4222"
+		return nil
+	}
+}
+
+//
+// set the cluster id of the nats streaming server.
+// defaults to test-cluster (the nats-streaming-server default)
+//
+func NatsCluster(cluster string) Option {
+	return func(s *OtfAlignService) error {
+		if cluster != "" {
+			s.natsCluster = cluster
+			return nil
+		}
+		s.natsCluster = "test-cluster"
+		return nil
+	}
+}
+
+//
+// set the client id the worker uses to connect to
+// nats streaming; must be unique among connected clients
+// and stable across restarts for the durable subscription
+// to be resumed.
+// defaults to otf_align_worker
+//
+func NatsClientID(id string) Option {
+	return func(s *OtfAlignService) error {
+		if id != "" {
+			s.natsClientID = id
+			return nil
+		}
+		s.natsClientID = "otf_align_worker"
+		return nil
+	}
+}
+
+//
+// set the durable name of the worker subscription.
+// defaults to otf_align
+//
+func NatsDurable(name string) Option {
+	return func(s *OtfAlignService) error {
+		if name != "" {
+			s.natsDurable = name
+			return nil
+		}
+		s.natsDurable = "otf_align"
+		return nil
+	}
+}
+
+//
+// set a queue group for the worker subscription, so that
+// multiple workers share the ingest messages between them.
+// if no group given each worker receives every message
+//
+func NatsQueue(group string) Option {
+	return func(s *OtfAlignService) error {
+		s.natsQueue = group
+		return nil
+	}
+}
+
+//
+// set the subject the worker consumes otf-reader messages from.
+// defaults to otf.ingest
+//
+func IngestSubject(subject string) Option {
+	return func(s *OtfAlignService) error {
+		if subject != "" {
+			s.ingestSubject = subject
+			return nil
+		}
+		s.ingestSubject = "otf.ingest"
+		return nil
+	}
+}
+
+//
+// set the subject the worker publishes aligned messages to.
+// defaults to otf.aligned
+//
+func AlignedSubject(subject string) Option {
+	return func(s *OtfAlignService) error {
+		if subject != "" {
+			s.alignedSubject = subject
+			return nil
+		}
+		s.alignedSubject = "otf.aligned"
+		return nil
+	}
+}
+
+//
+// set the subject the worker publishes messages that
+// could not be aligned to.
+// defaults to otf.align.failed
+//
+func DeadLetterSubject(subject string) Option {
+	return func(s *OtfAlignService) error {
+		if subject != "" {
+			s.deadLetterSubject = subject
+			return nil
+		}
+		s.deadLetterSubject = "otf.align.failed"
+		return nil
+	}
+}
+
+//
+// set the max number of messages the worker
+// aligns concurrently.
+// defaults to 8 if no value given
+//
+func WorkerConcurrency(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n > 0 {
+			s.workerConcurrency = n
+			return nil
+		}
+		s.workerConcurrency = defaultWorkerConcurrency
+		return nil
+	}
+}
+
+//
+// register rules for extracting align requests from the
+// otf-reader messages of data providers, used by the worker
+// and /align/envelope.
+// a profile with the same name as a built-in provider
+// (BrightPath|MathsPathway|SPA|LPOFA) replaces the built-in
+//
+func ProviderProfiles(profiles ...ProviderProfile) Option {
+	return func(s *OtfAlignService) error {
+		for _, p := range profiles {
+			if err := s.registerProviderProfile(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+//
+// register provider profiles read from a json file
+// containing an array of profiles.
+// no profiles are read if no file given
+//
+func ProviderProfileFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		if fname == "" {
+			return nil
+		}
+		profiles, err := readProviderProfiles(fname)
+		if err != nil {
+			return err
+		}
+		return ProviderProfiles(profiles...)(s)
+	}
+}
+
+//
+// set where the alignment maps used for mapped
+// alignment are held; one of
+// n3w: the nias3 web server (default)
+// local: an embedded store within the service, so
+// no n3w is needed
+//
+func MapBackend(backend string) Option {
+	return func(s *OtfAlignService) error {
+		switch backend {
+		case "":
+			s.mapBackend = "n3w"
+		case "n3w", "local":
+			s.mapBackend = backend
+		default:
+			return errors.Errorf("unknown map backend: %q, must be one of n3w|local", backend)
+		}
+		return nil
+	}
+}
+
+//
+// set the file used for the local map store, so
+// maps are kept between restarts.
+// if no file given a temporary store is used, which
+// is discarded when the service shuts down
+//
+func MapStoreFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.mapStoreFile = fname
+		return nil
+	}
+}
+
+//
+// set json or csv files of alignment map records to
+// load into the local map store at startup, in the same
+// forms accepted by /maps
+//
+func MapFiles(fnames ...string) Option {
+	return func(s *OtfAlignService) error {
+		for _, f := range fnames {
+			if f = strings.TrimSpace(f); f != "" {
+				s.mapFiles = append(s.mapFiles, f)
+			}
+		}
+		return nil
+	}
+}
+
+//
+// set a json or xml file of the nlp progression to
+// load at startup, used to resolve nlp references for
+// prescribed and mapped alignment without calling the
+// classifier.
+// if no file given all lookups use the classifier
+//
+func NLPFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.nlpFile = fname
+		return nil
+	}
+}
+
+//
+// set whether nlp references not found in the local nlp
+// dataset are looked up with the classifier.
+// has no effect if no nlp file is loaded
+//
+func ClassifierFallback(enabled bool) Option {
+	return func(s *OtfAlignService) error {
+		s.classifierFallback = enabled
+		return nil
+	}
+}
+
+//
+// set how inferred alignment is done; one of
+// classifier: the otf-classifier service (default)
+// local: an index of the nlp dataset within the service,
+// so no classifier is needed; requires an nlp file
+//
+func InferenceBackend(backend string) Option {
+	return func(s *OtfAlignService) error {
+		switch backend {
+		case "":
+			s.inferenceBackend = "classifier"
+		case "classifier", "local":
+			s.inferenceBackend = backend
+		default:
+			return errors.Errorf("unknown inference backend: %q, must be one of classifier|local", backend)
+		}
+		return nil
+	}
+}
+
+//
+// set the minimum level of log entries written;
+// one of debug|info|warn|error.
+// defaults to info if no level given
+//
+func LogLevel(level string) Option {
+	return func(s *OtfAlignService) error {
+		switch level {
+		case "":
+			s.logLevel = "info"
+		case "debug", "info", "warn", "error":
+			s.logLevel = level
+		default:
+			return errors.Errorf("unknown log level: %q, must be one of debug|info|warn|error", level)
+		}
+		return nil
+	}
+}
+
+//
+// set the format of log entries; one of
+// json: one json object per entry (default)
+// text: human readable key=value entries
+//
+func LogFormat(format string) Option {
+	return func(s *OtfAlignService) error {
+		switch format {
+		case "":
+			s.logFormat = "json"
+		case "json", "text":
+			s.logFormat = format
+		default:
+			return errors.Errorf("unknown log format: %q, must be one of json|text", format)
+		}
+		return nil
+	}
+}
+
+//
+// set where trace spans are exported to; one of
+// none: spans are not recorded (default), trace context
+// is still passed on to upstream services
+// stdout: spans are written to stdout as json
+// otlp: spans are sent to an opentelemetry collector
+// over otlp/http, see TraceEndpoint
+//
+func TraceExporter(exporter string) Option {
+	return func(s *OtfAlignService) error {
+		switch exporter {
+		case "":
+			s.traceExporter = "none"
+		case "none", "stdout", "otlp":
+			s.traceExporter = exporter
+		default:
+			return errors.Errorf("unknown trace exporter: %q, must be one of none|stdout|otlp", exporter)
+		}
+		return nil
+	}
+}
+
+//
+// set the url of the opentelemetry collector spans are
+// sent to by the otlp exporter; use http:// for an
+// unencrypted connection.
+// defaults to http://localhost:4318
+//
+func TraceEndpoint(endpoint string) Option {
+	return func(s *OtfAlignService) error {
+		if endpoint == "" {
+			s.traceEndpoint = defaultTraceEndpoint
+			return nil
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.Errorf("invalid trace endpoint: %q, must be an http or https url e.g. http://localhost:4318", endpoint)
+		}
+		s.traceEndpoint = endpoint
+		return nil
+	}
+}
+
+//
+// set the fraction of traces started by this service that
+// are recorded, between 0 and 1; traces continued from a
+// caller follow the caller's sampling decision.
+// defaults to 1 (every trace) if no ratio given
+//
+func TraceSampleRatio(ratio float64) Option {
+	return func(s *OtfAlignService) error {
+		if ratio < 0 || ratio > 1 {
+			return errors.Errorf("trace sample ratio must be between 0 and 1, got %v", ratio)
+		}
+		if ratio == 0 {
+			ratio = 1
+		}
+		s.traceSampleRatio = ratio
+		return nil
+	}
+}
+
+//
+// set the shared secret used to verify HS256 bearer
+// tokens; setting a secret enables authentication
+//
+func JWTSecret(secret string) Option {
+	return func(s *OtfAlignService) error {
+		s.jwtSecret = secret
+		return nil
+	}
+}
+
+//
+// set a pem file holding the rsa public key used to verify
+// RS256 bearer tokens; setting a key enables authentication
+//
+func JWTKeyFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.jwtKeyFile = fname
+		return nil
+	}
+}
+
+//
+// set a json web key set (jwks) file holding the keys used
+// to verify bearer tokens, matched to tokens by their key id.
+// setting a key set enables authentication
+//
+func JWKSFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.jwksFile = fname
+		return nil
+	}
+}
+
+//
+// set the issuer (iss) bearer tokens must have.
+// if no issuer given tokens from any issuer are accepted
+//
+func JWTIssuer(issuer string) Option {
+	return func(s *OtfAlignService) error {
+		s.jwtIssuer = issuer
+		return nil
+	}
+}
+
+//
+// set the audience (aud) bearer tokens must include.
+// if no audience given tokens for any audience are accepted
+//
+func JWTAudience(audience string) Option {
+	return func(s *OtfAlignService) error {
+		s.jwtAudience = audience
+		return nil
+	}
+}
+
+//
+// set a json file of static api keys, each with the client
+// it identifies and the scopes it grants; setting a file
+// enables authentication
+//
+func APIKeyFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.apiKeyFile = fname
+		return nil
+	}
+}
+
+//
+// register custom authenticators with the service, tried
+// in turn before the built-in jwt and api key authenticators.
+// registering an authenticator enables authentication
+//
+func Authenticators(authenticators ...Authenticator) Option {
+	return func(s *OtfAlignService) error {
+		for _, a := range authenticators {
+			if a == nil {
+				return errors.New("authenticator cannot be nil")
+			}
+			s.authenticators = append(s.authenticators, a)
+		}
+		return nil
+	}
+}
+
+//
+// set the pem file of the certificate (and any intermediate
+// certificates) used to serve requests over https.
+// requires a key file; if no certificate given requests
+// are served over plain http
+//
+func TLSCertFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.tlsCertFile = fname
+		return nil
+	}
+}
+
+//
+// set the pem file of the private key of the tls certificate
+//
+func TLSKeyFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.tlsKeyFile = fname
+		return nil
+	}
+}
+
+//
+// set the pem file of the CAs that client certificates must
+// be signed by; every client must then present a valid
+// certificate (mutual tls). requires tls to be enabled.
+// if no file given client certificates are not requested
+//
+func TLSClientCAFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.tlsClientCAFile = fname
+		return nil
+	}
+}
+
+//
+// set the scheme used to call the nias3 web server;
+// one of http|https.
+// defaults to http if no scheme given
+//
+func NiasScheme(scheme string) Option {
+	return func(s *OtfAlignService) error {
+		switch scheme {
+		case "":
+			s.niasScheme = "http"
+		case "http", "https":
+			s.niasScheme = scheme
+		default:
+			return errors.Errorf("unknown nias scheme: %q, must be one of http|https", scheme)
+		}
+		return nil
+	}
+}
+
+//
+// set the scheme used to call the text classifier;
+// one of http|https.
+// defaults to http if no scheme given
+//
+func TcScheme(scheme string) Option {
+	return func(s *OtfAlignService) error {
+		switch scheme {
+		case "":
+			s.tcScheme = "http"
+		case "http", "https":
+			s.tcScheme = scheme
+		default:
+			return errors.Errorf("unknown classifier scheme: %q, must be one of http|https", scheme)
+		}
+		return nil
+	}
+}
+
+//
+// set the base url of the nias3 web server, including
+// scheme and any path prefix e.g.
+// https://proxy.example.com/n3w
+// several urls can be given for replicas of the server,
+// calls are spread across them (see UpstreamBalance).
+// overrides NiasScheme, NiasHost and NiasPort if given
+//
+func NiasURL(baseURLs ...string) Option {
+	return func(s *OtfAlignService) error {
+		urls, err := upstreamURLs("nias", baseURLs)
+		if err != nil {
+			return err
+		}
+		s.niasURLs = urls
+		return nil
+	}
+}
+
+//
+// set the base url of the text classifier, including
+// scheme and any path prefix e.g.
+// https://proxy.example.com/classifier
+// several urls can be given for replicas of the classifier,
+// calls are spread across them (see UpstreamBalance).
+// overrides TcScheme, TcHost and TcPort if given
+//
+func TcURL(baseURLs ...string) Option {
+	return func(s *OtfAlignService) error {
+		urls, err := upstreamURLs("classifier", baseURLs)
+		if err != nil {
+			return err
+		}
+		s.tcURLs = urls
+		return nil
+	}
+}
+
+//
+// checks each of a list of upstream base urls,
+// ignoring empty entries
+//
+func upstreamURLs(name string, baseURLs []string) ([]string, error) {
+
+	urls := []string{}
+	for _, baseURL := range baseURLs {
+		u, err := upstreamURL(name, strings.TrimSpace(baseURL))
+		if err != nil {
+			return nil, err
+		}
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls, nil
+}
+
+//
+// checks an upstream base url is an absolute http(s)
+// url without a query, and removes any trailing /
+//
+func upstreamURL(name, baseURL string) (string, error) {
+
+	if baseURL == "" {
+		return "", nil
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.Errorf("invalid %s url: %q, must be an http or https base url e.g. http://localhost:1576", name, baseURL)
+	}
+	return strings.TrimSuffix(baseURL, "/"), nil
+}
+
+//
+// set the path of the n3w graphql endpoint,
+// relative to the nias base url.
+// defaults to /n3/graphql if no path given
+//
+func NiasGraphQLPath(path string) Option {
+	return endpointPath("nias graphql", path, defaultNiasGraphQLPath, func(s *OtfAlignService) *string { return &s.niasGraphQLPath })
+}
+
+//
+// set the path of the n3w publish endpoint maps are
+// posted to, relative to the nias base url.
+// defaults to /n3/publish if no path given
+//
+func NiasPublishPath(path string) Option {
+	return endpointPath("nias publish", path, defaultNiasPublishPath, func(s *OtfAlignService) *string { return &s.niasPublishPath })
+}
+
+//
+// set the path of the n3w endpoint that creates the
+// maps context, relative to the nias base url.
+// defaults to /admin/newdemocontext if no path given
+//
+func NiasContextPath(path string) Option {
+	return endpointPath("nias context", path, defaultNiasContextPath, func(s *OtfAlignService) *string { return &s.niasContextPath })
+}
+
+//
+// set the path of the classifier align endpoint,
+// relative to the classifier base url.
+// defaults to /align if no path given
+//
+func TcAlignPath(path string) Option {
+	return endpointPath("classifier align", path, defaultTcAlignPath, func(s *OtfAlignService) *string { return &s.tcAlignPath })
+}
+
+//
+// set the path of the classifier lookup endpoint,
+// relative to the classifier base url.
+// defaults to /lookup if no path given
+//
+func TcLookupPath(path string) Option {
+	return endpointPath("classifier lookup", path, defaultTcLookupPath, func(s *OtfAlignService) *string { return &s.tcLookupPath })
+}
+
+//
+// creates an option setting an upstream endpoint path,
+// which must start with / and have no query
+//
+func endpointPath(name, path, def string, field func(s *OtfAlignService) *string) Option {
+	return func(s *OtfAlignService) error {
+		if path == "" {
+			path = def
+		}
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#") {
+			return errors.Errorf("invalid %s path: %q, must start with / and have no query", name, path)
+		}
+		*field(s) = path
+		return nil
+	}
+}
+
+//
+// set the pem file of additional CAs trusted to sign the
+// certificates of n3w and the text classifier when they are
+// called over https, e.g. a private school network CA.
+// the system CAs are always trusted
+//
+func UpstreamCAFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.upstreamCAFile = fname
+		return nil
+	}
+}
+
+//
+// set the pem file of the client certificate presented to
+// n3w and the text classifier when they are called over
+// https and ask for one (mutual tls). requires a key file
+//
+func UpstreamCertFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.upstreamCertFile = fname
+		return nil
+	}
+}
+
+//
+// set the pem file of the private key of the upstream
+// client certificate
+//
+func UpstreamKeyFile(fname string) Option {
+	return func(s *OtfAlignService) error {
+		s.upstreamKeyFile = fname
+		return nil
+	}
+}
+
+//
+// set the number of requests per second each client may
+// make on average; clients exceeding it are rejected with
+// 429 and a Retry-After header.
+// clients are identified by their credentials when
+// authentication is enabled, otherwise by address.
+// defaults to 0, no limit
+//
+func RateLimit(perSecond float64) Option {
+	return func(s *OtfAlignService) error {
+		if perSecond < 0 {
+			return errors.New("rate limit cannot be negative")
+		}
+		s.rateLimit = perSecond
+		return nil
+	}
+}
+
+//
+// set the number of requests a client may make in a burst
+// above its rate limit.
+// defaults to the rate limit (rounded up) if no value given
+//
+func RateBurst(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n < 0 {
+			return errors.New("rate burst cannot be negative")
+		}
+		s.rateBurst = n
+		return nil
+	}
+}
+
+//
+// set the max number of calls to n3w and the text classifier
+// in flight at once, across all requests; alignments needing
+// a call when the max is reached fail with 429.
+// defaults to 0, no limit
+//
+func MaxUpstreamCalls(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n < 0 {
+			return errors.New("max upstream calls cannot be negative")
+		}
+		s.maxUpstreamCalls = n
+		return nil
+	}
+}
+
+//
+// set how calls are spread across the replicas of n3w and
+// the classifier given to NiasURL and TcURL; one of
+// round-robin|least-loaded.
+// defaults to round-robin if no policy given
+//
+func UpstreamBalance(policy string) Option {
+	return func(s *OtfAlignService) error {
+		switch policy {
+		case "":
+			s.balancePolicy = util.BalanceRoundRobin
+		case util.BalanceRoundRobin, util.BalanceLeastLoaded:
+			s.balancePolicy = policy
+		default:
+			return errors.Errorf("unknown upstream balance policy: %q, must be one of round-robin|least-loaded", policy)
+		}
+		return nil
+	}
+}
+
+//
+// set the number of consecutive failed calls to an upstream
+// replica that eject it; an ejected replica is not called
+// for the eject time unless all the others are ejected too.
+// defaults to 3 if 0 given, a negative value never ejects
+//
+func EjectThreshold(n int) Option {
+	return func(s *OtfAlignService) error {
+		if n != 0 {
+			s.ejectThreshold = n
+			return nil
+		}
+		s.ejectThreshold = 3
+		return nil
+	}
+}
+
+//
+// set how long an ejected upstream replica is left out
+// before calls are sent to it again.
+// defaults to 30 seconds if no value given
+//
+func EjectTime(d time.Duration) Option {
+	return func(s *OtfAlignService) error {
+		if d > 0 {
+			s.ejectTime = d
+			return nil
+		}
+		s.ejectTime = 30 * time.Second
+		return nil
+	}
+}
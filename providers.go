@@ -0,0 +1,398 @@
+package otfalign
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+//
+// rules for building an align request from the otf-reader
+// messages of a data provider.
+//
+// all paths are gjson paths into the full message envelope
+// e.g. "original.module_id" or "meta.capability"
+//
+type ProviderProfile struct {
+	// provider name, matched against meta.providerName
+	Name string `json:"name"`
+	// the profile also applies to messages containing any of
+	// these paths, whatever their provider name (e.g. xapi statements)
+	MatchPaths []string `json:"matchPaths,omitempty"`
+	// paths of the values making up the align token; a single
+	// value is used as is, several are joined into a string.
+	// the message has no token if any value is missing
+	TokenPaths []string `json:"tokenPaths"`
+	// separator used to join several token values, defaults to a space
+	TokenSeparator string `json:"tokenSeparator,omitempty"`
+	// the message is skipped (not aligned) if any of
+	// these paths are missing or null
+	RequiredPaths []string `json:"requiredPaths,omitempty"`
+	// path of the align method, defaults to meta.alignMethod
+	MethodPath string `json:"methodPath,omitempty"`
+	// align method used if none found at MethodPath
+	Method string `json:"method,omitempty"`
+	// path of the general capability, defaults to meta.capability
+	CapabilityPath string `json:"capabilityPath,omitempty"`
+	// capability used if none found at CapabilityPath
+	Capability string `json:"capability,omitempty"`
+	// student identity fields to add to the otf.id block,
+	// keyed by field name with the path of the value
+	IDPaths map[string]string `json:"idPaths,omitempty"`
+	// fixed student identity fields to add to the otf.id block
+	IDValues map[string]interface{} `json:"idValues,omitempty"`
+}
+
+//
+// the provider profiles available by default, replicating the
+// rules of the original benthos alignData workflow
+//
+func defaultProviderProfiles() []ProviderProfile {
+	return []ProviderProfile{
+		{
+			Name:          "BrightPath",
+			TokenPaths:    []string{"original.test.scale", "original.score"},
+			RequiredPaths: []string{"original.score"}, // ignore students with null score
+			IDPaths: map[string]string{
+				"studentID":         "original.student_participation.enrolment.student.identifiers.0.identifier",
+				"studentGivenName":  "original.student_participation.enrolment.student.first_name",
+				"studentFamilyName": "original.student_participation.enrolment.student.last_name",
+			},
+		},
+		{
+			Name:       "MathsPathway",
+			TokenPaths: []string{"original.module_id"},
+			IDPaths: map[string]string{
+				"studentID": "original.student_id",
+			},
+			IDValues: map[string]interface{}{
+				"studentFullName": "not provided",
+			},
+		},
+		{
+			Name:       "SPA",
+			TokenPaths: []string{"original.TestCode"},
+			IDPaths: map[string]string{
+				"studentID":         "original.StudentID",
+				"studentGivenName":  "original.FirstName",
+				"studentFamilyName": "original.LastName",
+			},
+		},
+		{
+			// xapi statements
+			Name:       "LPOFA",
+			MatchPaths: []string{"original.actor.mbox"},
+			TokenPaths: []string{"original.object.definition.description.en-US"},
+			IDPaths: map[string]string{
+				"studentID":       "original.actor.mbox",
+				"studentFullName": "original.actor.name",
+			},
+		},
+	}
+}
+
+//
+// checks a profile has the minimum needed to build an align request
+//
+func (p *ProviderProfile) validate() error {
+
+	if p.Name == "" {
+		return errors.New("provider profile must have a name")
+	}
+	if len(p.TokenPaths) == 0 {
+		return errors.Errorf("provider profile %s must have at least one token path", p.Name)
+	}
+	return nil
+}
+
+//
+// reads a json array of provider profiles from file
+//
+func readProviderProfiles(fname string) ([]ProviderProfile, error) {
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read provider profiles file")
+	}
+	var profiles []ProviderProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse provider profiles file %s", fname)
+	}
+	return profiles, nil
+}
+
+//
+// adds a provider profile to the service, replacing
+// any existing profile with the same name
+//
+func (s *OtfAlignService) registerProviderProfile(p ProviderProfile) error {
+
+	if err := p.validate(); err != nil {
+		return err
+	}
+	for i := range s.profiles {
+		if s.profiles[i].Name == p.Name {
+			s.profiles[i] = p
+			return nil
+		}
+	}
+	s.profiles = append(s.profiles, p)
+	return nil
+}
+
+//
+// adds the default provider profiles, without replacing
+// any profiles configured for the same providers
+//
+func (s *OtfAlignService) registerDefaultProviderProfiles() {
+
+	for _, p := range defaultProviderProfiles() {
+		if s.providerProfile(p.Name) == nil {
+			s.profiles = append(s.profiles, p)
+		}
+	}
+}
+
+//
+// returns the profile for the named provider, or nil if none
+//
+func (s *OtfAlignService) providerProfile(name string) *ProviderProfile {
+
+	for i := range s.profiles {
+		if s.profiles[i].Name == name {
+			return &s.profiles[i]
+		}
+	}
+	return nil
+}
+
+//
+// finds the profile that applies to a message; a profile
+// matching the provider name takes precedence over
+// one matching by path
+//
+func (s *OtfAlignService) matchProviderProfile(env gjson.Result) *ProviderProfile {
+
+	if p := s.providerProfile(env.Get("meta.providerName").String()); p != nil {
+		return p
+	}
+	for i := range s.profiles {
+		for _, path := range s.profiles[i].MatchPaths {
+			if env.Get(path).Exists() {
+				return &s.profiles[i]
+			}
+		}
+	}
+	return nil
+}
+
+//
+// the details needed to align a message received
+// from an otf-reader, and to identify the student
+// it concerns
+//
+type envelopeAlignment struct {
+	// the align request built from the message
+	request AlignRequest
+	// student identity fields to add to the otf.id block
+	ids map[string]interface{}
+}
+
+//
+// extracts the align request and student identity from
+// an otf-reader message envelope, using the profile
+// for the message's provider.
+//
+// returns skip=true (with no error) if the message should not
+// be aligned, such as a BrightPath result with no score
+//
+func (s *OtfAlignService) extractEnvelope(msg []byte) (ea *envelopeAlignment, skip bool, err error) {
+
+	if !gjson.ValidBytes(msg) {
+		return nil, false, errors.New("message is not valid json")
+	}
+	env := gjson.ParseBytes(msg)
+
+	p := s.matchProviderProfile(env)
+	if p == nil {
+		return nil, false, errors.Errorf("no alignment rules for provider: %q", env.Get("meta.providerName").String())
+	}
+
+	for _, path := range p.RequiredPaths {
+		if v := env.Get(path); !v.Exists() || v.Type == gjson.Null {
+			return nil, true, nil
+		}
+	}
+
+	ea = &envelopeAlignment{
+		request: AlignRequest{
+			AlignMethod:     envelopeValue(env, p.MethodPath, "meta.alignMethod", p.Method),
+			AlignCapability: envelopeValue(env, p.CapabilityPath, "meta.capability", p.Capability),
+			AlignToken:      envelopeToken(env, p),
+		},
+		ids: map[string]interface{}{},
+	}
+	if ea.request.AlignToken == nil {
+		return nil, false, errors.Errorf("no align token found in %s message", p.Name)
+	}
+	for k, v := range p.IDValues {
+		ea.ids[k] = v
+	}
+	for k, path := range p.IDPaths {
+		ea.ids[k] = env.Get(path).Value()
+	}
+
+	return ea, false, nil
+}
+
+//
+// returns the string at path (or defaultPath if no path given),
+// or fallback if there is no value there
+//
+func envelopeValue(env gjson.Result, path, defaultPath, fallback string) string {
+
+	if path == "" {
+		path = defaultPath
+	}
+	if v := env.Get(path).String(); v != "" {
+		return v
+	}
+	return fallback
+}
+
+//
+// builds the align token from the profile token paths.
+// returns nil if any token value is missing or null, as
+// a token built from only some of its parts would align
+// to the wrong nlps
+//
+func envelopeToken(env gjson.Result, p *ProviderProfile) interface{} {
+
+	if len(p.TokenPaths) == 1 {
+		return env.Get(p.TokenPaths[0]).Value()
+	}
+
+	sep := p.TokenSeparator
+	if sep == "" {
+		sep = " "
+	}
+	parts := make([]string, 0, len(p.TokenPaths))
+	for _, path := range p.TokenPaths {
+		v := env.Get(path)
+		if !v.Exists() || v.Type == gjson.Null {
+			return nil
+		}
+		parts = append(parts, fmt.Sprintf("%v", v.Value()))
+	}
+	return strings.Join(parts, sep)
+}
+
+//
+// merges the alignment results and student identity
+// into the otf block of the original message, in the
+// form produced by the benthos alignData workflow
+//
+// returns the enriched message as json
+//
+func enrichEnvelope(msg []byte, ea *envelopeAlignment, resp *AlignResponse) ([]byte, error) {
+
+	var env map[string]interface{}
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal message")
+	}
+
+	otf, ok := env["otf"].(map[string]interface{})
+	if !ok {
+		otf = map[string]interface{}{}
+	}
+	otf["align"] = map[string]interface{}{
+		"method":               resp.AlignMethod,
+		"effectiveMethod":      resp.EffectiveMethod,
+		"fallback":             resp.Fallback,
+		"token":                resp.AlignToken,
+		"capability":           resp.AlignCapability,
+		"alignments":           resp.Alignments,
+		"alignmentServiceID":   resp.AlignServiceID,
+		"alignmentServiceName": resp.AlignServiceName,
+	}
+	ids, ok := otf["id"].(map[string]interface{})
+	if !ok {
+		ids = map[string]interface{}{}
+	}
+	for k, v := range ea.ids {
+		ids[k] = v
+	}
+	otf["id"] = ids
+	env["otf"] = otf
+
+	return json.Marshal(env)
+}
+
+//
+// extracts the align request from an otf-reader message,
+// aligns it, and merges the results back into the message
+//
+// returns skip=true if the message needs no alignment;
+// messages that cannot be aligned are reported as a
+// bad request
+//
+func (s *OtfAlignService) alignEnvelope(ctx context.Context, msg []byte) (enriched []byte, skip bool, err error) {
+
+	ea, skip, err := s.extractEnvelope(msg)
+	if err != nil {
+		return nil, false, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if skip {
+		return nil, true, nil
+	}
+
+	resp, err := s.align(ctx, &ea.request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	enriched, err = enrichEnvelope(msg, ea, resp)
+	return enriched, false, err
+}
+
+//
+// max size of an otf-reader message posted for
+// alignment, larger messages are rejected
+//
+const maxEnvelopeBodySize = 1 << 20
+
+//
+// creates the envelope align method
+// accepts a complete otf-reader message, and returns
+// the message with the alignment results added to
+// its otf block, as the worker would publish it.
+//
+// messages that need no alignment return
+// 422 Unprocessable Entity
+//
+func (s *OtfAlignService) buildEnvelopeAlignHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		msg, err := readBody(c, maxEnvelopeBodySize)
+		if err != nil {
+			return err
+		}
+
+		enriched, skip, err := s.alignEnvelope(c.Request().Context(), msg)
+		if err != nil {
+			return err
+		}
+		if skip {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "message requires no alignment")
+		}
+
+		return c.JSONBlob(http.StatusOK, enriched)
+	}
+}
@@ -0,0 +1,36 @@
+package otfalign
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestEnvelopeToken(t *testing.T) {
+
+	brightPath := &ProviderProfile{TokenPaths: []string{"original.test.scale", "original.score"}}
+	mathsPathway := &ProviderProfile{TokenPaths: []string{"original.module_id"}}
+
+	tests := []struct {
+		name    string
+		profile *ProviderProfile
+		message string
+		// expected token, nil if the message has none
+		token interface{}
+	}{
+		{"all parts", brightPath, `{"original": {"test": {"scale": "Persuasive Writing"}, "score": 410}}`, "Persuasive Writing 410"},
+		{"missing part", brightPath, `{"original": {"score": 410}}`, nil},
+		{"null part", brightPath, `{"original": {"test": {"scale": null}, "score": 410}}`, nil},
+		{"custom separator", &ProviderProfile{TokenPaths: brightPath.TokenPaths, TokenSeparator: "|"},
+			`{"original": {"test": {"scale": "Reading"}, "score": 350}}`, "Reading|350"},
+		{"single value", mathsPathway, `{"original": {"module_id": "00e6a88e"}}`, "00e6a88e"},
+		{"single value missing", mathsPathway, `{"original": {}}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if token := envelopeToken(gjson.Parse(tt.message), tt.profile); token != tt.token {
+				t.Errorf("expected token %v, got %v", tt.token, token)
+			}
+		})
+	}
+}
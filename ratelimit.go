@@ -0,0 +1,204 @@
+package otfalign
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+//
+// how long a client's token bucket is kept
+// after its last request
+//
+const clientIdleTimeout = 5 * time.Minute
+
+//
+// an error carrying how long the caller should
+// wait before trying again
+//
+type retryAfterError time.Duration
+
+func (e retryAfterError) Error() string {
+	return fmt.Sprintf("retry after %s", time.Duration(e))
+}
+
+//
+// returns a 429 error telling the caller when to retry
+//
+func tooManyRequests(msg string, retryAfter time.Duration) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusTooManyRequests, msg).SetInternal(retryAfterError(retryAfter))
+}
+
+//
+// writes error responses with the default echo handler,
+// adding a Retry-After header to 429 responses
+//
+func (s *OtfAlignService) errorHandler(err error, c echo.Context) {
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code == http.StatusTooManyRequests {
+		wait := time.Second
+		var ra retryAfterError
+		if errors.As(he.Internal, &ra) {
+			wait = time.Duration(ra)
+		}
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	s.e.DefaultHTTPErrorHandler(err, c)
+}
+
+//
+// token bucket rate limits per client, implementing
+// the echo RateLimiterStore
+//
+type clientLimiter struct {
+	mu sync.Mutex
+	// tokens added to each bucket per second
+	rate rate.Limit
+	// size of each bucket
+	burst int
+	// bucket for each client, by rate limit key
+	clients map[string]*clientBucket
+	// when idle buckets were last removed
+	lastCleanup time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+//
+// create a limiter allowing each client perSecond requests
+// per second on average, and bursts of up to burst requests
+//
+func newClientLimiter(perSecond float64, burst int) *clientLimiter {
+	return &clientLimiter{
+		rate:        rate.Limit(perSecond),
+		burst:       burst,
+		clients:     map[string]*clientBucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+//
+// takes a token from the client's bucket.
+// if the bucket is empty returns false, with a
+// retryAfterError for when the next token is due
+//
+func (cl *clientLimiter) Allow(key string) (bool, error) {
+
+	now := time.Now()
+	r := cl.bucket(key, now).ReserveN(now, 1)
+	if !r.OK() {
+		return false, retryAfterError(time.Second)
+	}
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return false, retryAfterError(wait)
+	}
+	return true, nil
+}
+
+//
+// checks the client's bucket has a token left, without
+// taking it. if the bucket is empty returns a
+// retryAfterError for when the next token is due
+//
+func (cl *clientLimiter) Check(key string) error {
+
+	now := time.Now()
+	l := cl.bucket(key, now)
+	if l.TokensAt(now) >= 1 {
+		return nil
+	}
+	r := l.ReserveN(now, 1)
+	if !r.OK() {
+		return retryAfterError(time.Second)
+	}
+	wait := r.DelayFrom(now)
+	r.CancelAt(now)
+	return retryAfterError(wait)
+}
+
+//
+// returns the client's bucket, creating it if needed,
+// and removes the buckets of clients gone idle
+//
+func (cl *clientLimiter) bucket(key string, now time.Time) *rate.Limiter {
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	b, ok := cl.clients[key]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(cl.rate, cl.burst)}
+		cl.clients[key] = b
+	}
+	b.lastSeen = now
+	if now.Sub(cl.lastCleanup) > clientIdleTimeout {
+		for k, idle := range cl.clients {
+			if now.Sub(idle.lastSeen) > clientIdleTimeout {
+				delete(cl.clients, k)
+			}
+		}
+		cl.lastCleanup = now
+	}
+	return b.limiter
+}
+
+//
+// rejects requests from clients that have used up their
+// rate limit with 429.
+// authenticated clients are limited by client name, others
+// by the address connecting to the service (not headers such
+// as X-Forwarded-For, which callers can set).
+// probes and metrics scrapes are not limited
+//
+func (s *OtfAlignService) rateLimiter() echo.MiddlewareFunc {
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Skipper: func(c echo.Context) bool {
+			return quietPaths[c.Path()]
+		},
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return rateLimitKey(c.Request()), nil
+		},
+		Store: s.limiter,
+		DenyHandler: func(c echo.Context, key string, err error) error {
+			s.observeRateLimited("client")
+			s.logger(c.Request().Context()).WithField("rateLimitKey", key).Debug("rate limit exceeded")
+			wait := time.Second
+			if ra, ok := err.(retryAfterError); ok {
+				wait = time.Duration(ra)
+			}
+			return tooManyRequests("rate limit exceeded", wait)
+		},
+	})
+}
+
+//
+// identifies the client a request counts against
+//
+func rateLimitKey(r *http.Request) string {
+
+	if p, ok := r.Context().Value(principalKey{}).(*Principal); ok {
+		return "client:" + p.Name
+	}
+	return addressKey(r)
+}
+
+//
+// identifies a request by the address connecting to the service
+//
+func addressKey(r *http.Request) string {
+	return "ip:" + echo.ExtractIPDirect()(r)
+}
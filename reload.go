@@ -0,0 +1,298 @@
+package otfalign
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// returns the token used to call n3w, which
+// can be changed by a reload
+//
+func (s *OtfAlignService) n3wToken() string {
+
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+	return s.niasToken
+}
+
+//
+// Reload applies a new configuration to the running service,
+// without restarting the http server or dropping alignments
+// in flight.
+//
+// options are the full configuration, as passed to New;
+// settings not given return to their defaults. If any option
+// is invalid the whole configuration is rejected, and the
+// current configuration is kept.
+//
+// the settings that take effect are the n3w and classifier
+// addresses (NiasURL, NiasScheme/Host/Port, TcURL,
+// TcScheme/Host/Port, UpstreamBalance, EjectThreshold and
+// EjectTime), the nias token, the cache size and ttl, and the
+// log level and format. Changes to other settings are logged
+// as needing a restart, and ignored.
+//
+func (s *OtfAlignService) Reload(options ...Option) error {
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	// start from the current identity and port, so
+	// none are generated afresh if not configured
+	next := &OtfAlignService{
+		serviceName: s.serviceName,
+		serviceID:   s.serviceID,
+		servicePort: s.servicePort,
+	}
+	if err := next.setOptions(options...); err != nil {
+		return s.rejectReload(err)
+	}
+	next.defaultEndpointPaths()
+
+	// nothing below can fail, so the configuration
+	// is applied in full or not at all
+	changed := []string{}
+
+	if s.cache != nil && next.cacheSize >= 0 {
+		size := cacheSizeOrDefault(next.cacheSize)
+		if size != cacheSizeOrDefault(s.cacheSize) || next.cacheTTL != s.cacheTTL {
+			if err := s.cache.SetLimits(size, next.cacheTTL); err != nil {
+				return s.rejectReload(err)
+			}
+			changed = append(changed, "cache")
+			s.cacheSize, s.cacheTTL = next.cacheSize, next.cacheTTL
+		}
+	}
+
+	if token := next.niasToken; token != s.n3wToken() {
+		s.tokenMu.Lock()
+		s.niasToken = token
+		s.tokenMu.Unlock()
+		changed = append(changed, "niasToken")
+	}
+
+	n3wChanged := !reflect.DeepEqual(next.niasBaseURLs(), s.niasBaseURLs())
+	tcChanged := !reflect.DeepEqual(next.tcBaseURLs(), s.tcBaseURLs())
+	threshold, ejectTime := next.ejectSettings()
+	curThreshold, curEjectTime := s.ejectSettings()
+	balanceChanged := next.balancePolicy != s.balancePolicy ||
+		threshold != curThreshold || ejectTime != curEjectTime
+	if n3wChanged || balanceChanged {
+		s.n3w.Endpoints.Update(next.niasBaseURLs(), next.balancePolicy, threshold, ejectTime)
+	}
+	if tcChanged || balanceChanged {
+		s.classifier.Endpoints.Update(next.tcBaseURLs(), next.balancePolicy, threshold, ejectTime)
+	}
+	if n3wChanged {
+		changed = append(changed, "n3w endpoints")
+	}
+	if tcChanged {
+		changed = append(changed, "classifier endpoints")
+	}
+	if balanceChanged {
+		changed = append(changed, "upstream balance")
+	}
+	s.niasURLs, s.niasScheme, s.niasHost, s.niasPort = next.niasURLs, next.niasScheme, next.niasHost, next.niasPort
+	s.tcURLs, s.tcScheme, s.tcHost, s.tcPort = next.tcURLs, next.tcScheme, next.tcHost, next.tcPort
+	s.balancePolicy, s.ejectThreshold, s.ejectTime = next.balancePolicy, next.ejectThreshold, next.ejectTime
+
+	if logLevel(next.logLevel) != logLevel(s.logLevel) {
+		s.log.Logger.SetLevel(logLevel(next.logLevel))
+		changed = append(changed, "logLevel")
+	}
+	if (next.logFormat == "text") != (s.logFormat == "text") {
+		s.log.Logger.SetFormatter(logFormatter(next.logFormat))
+		changed = append(changed, "logFormat")
+	}
+	s.logLevel, s.logFormat = next.logLevel, next.logFormat
+
+	s.observeReload("applied")
+	l := s.log.WithField("changed", changed)
+	if ignored := s.restartChanges(next); len(ignored) > 0 {
+		l.WithField("ignored", ignored).Warn("configuration reloaded, changes to ignored settings need a restart")
+		return nil
+	}
+	if len(changed) == 0 {
+		l.Debug("configuration reloaded, no changes")
+		return nil
+	}
+	l.Info("configuration reloaded")
+	return nil
+}
+
+//
+// logs and returns the reason a new configuration
+// was not applied
+//
+func (s *OtfAlignService) rejectReload(err error) error {
+
+	s.observeReload("rejected")
+	s.log.WithError(err).Error("configuration rejected, keeping the current configuration")
+	return errors.Wrap(err, "configuration rejected")
+}
+
+//
+// returns the names of the settings that differ in
+// the new configuration but can only be changed by a
+// restart
+//
+func (s *OtfAlignService) restartChanges(next *OtfAlignService) []string {
+
+	current, proposed := s.restartSettings(), next.restartSettings()
+	names := []string{}
+	for name, v := range current {
+		if !reflect.DeepEqual(v, proposed[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//
+// the settings only read when the service is created
+//
+func (s *OtfAlignService) restartSettings() map[string]interface{} {
+
+	return map[string]interface{}{
+		"name":               s.serviceName,
+		"id":                 s.serviceID,
+		"port":               s.servicePort,
+		"host":               s.serviceHost,
+		"tlsCert":            s.tlsCertFile,
+		"tlsKey":             s.tlsKeyFile,
+		"tlsClientCA":        s.tlsClientCAFile,
+		"niasGraphQLPath":    s.niasGraphQLPath,
+		"niasPublishPath":    s.niasPublishPath,
+		"niasContextPath":    s.niasContextPath,
+		"tcAlignPath":        s.tcAlignPath,
+		"tcLookupPath":       s.tcLookupPath,
+		"upstreamCA":         s.upstreamCAFile,
+		"upstreamCert":       s.upstreamCertFile,
+		"upstreamKey":        s.upstreamKeyFile,
+		"upstreamTimeout":    s.upstreamTimeout,
+		"upstreamRetries":    s.retryPolicy,
+		"breakerThreshold":   s.breakerThreshold,
+		"breakerCooldown":    s.breakerCooldown,
+		"requestTimeout":     s.requestTimeout,
+		"rateLimit":          s.rateLimit,
+		"rateBurst":          s.rateBurst,
+		"maxUpstreamCalls":   s.maxUpstreamCalls,
+		"batchWorkers":       s.batchWorkers,
+		"maxBatchSize":       s.maxBatchSize,
+		"cacheEnabled":       s.cacheSize >= 0,
+		"cacheFile":          s.cacheFile,
+		"nlpFile":            s.nlpFile,
+		"classifierFallback": s.classifierFallback,
+		"inference":          s.inferenceBackend,
+		"mapBatchSize":       s.mapBatchSize,
+		"mapBackend":         s.mapBackend,
+		"mapStoreFile":       s.mapStoreFile,
+		"mapFiles":           s.mapFiles,
+		"traceExporter":      s.traceExporter,
+		"traceEndpoint":      s.traceEndpoint,
+		"traceSampleRatio":   s.traceSampleRatio,
+		"jwtSecret":          s.jwtSecret,
+		"jwtKeyFile":         s.jwtKeyFile,
+		"jwksFile":           s.jwksFile,
+		"jwtIssuer":          s.jwtIssuer,
+		"jwtAudience":        s.jwtAudience,
+		"apiKeyFile":         s.apiKeyFile,
+		"natsURL":            s.natsURL,
+		"natsCluster":        s.natsCluster,
+		"natsClientID":       s.natsClientID,
+		"natsDurable":        s.natsDurable,
+		"natsQueue":          s.natsQueue,
+		"ingestSubject":      s.ingestSubject,
+		"alignedSubject":     s.alignedSubject,
+		"deadLetterSubject":  s.deadLetterSubject,
+		"workerConcurrency":  s.workerConcurrency,
+	}
+}
+
+//
+// WatchConfig reloads the configuration whenever the config
+// file changes, checking every interval (0 to not check), or
+// the process receives SIGHUP, until the service is shut down.
+//
+// load reads the full configuration, including the file, and
+// returns it as options for Reload; if it fails the current
+// configuration is kept and the error is logged
+//
+func (s *OtfAlignService) WatchConfig(file string, interval time.Duration, load func() ([]Option, error)) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if file != "" && interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	modTime := configModTime(file)
+
+	reload := func(reason string) {
+		s.log.WithFields(logrus.Fields{"reason": reason, "file": file}).Info("reloading configuration")
+		opts, err := load()
+		if err != nil {
+			s.rejectReload(err)
+			return
+		}
+		s.Reload(opts...)
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-s.baseCtx.Done():
+				return
+			case <-hup:
+				modTime = configModTime(file)
+				reload("SIGHUP")
+			case <-tick:
+				if mt := configModTime(file); !mt.Equal(modTime) {
+					modTime = mt
+					reload("file changed")
+				}
+			}
+		}
+	}()
+}
+
+//
+// the last modification time of the config file,
+// zero if it cannot be read
+//
+func configModTime(file string) time.Time {
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+//
+// the configured number of results held in memory by
+// the cache, or its default
+//
+func cacheSizeOrDefault(size int) int {
+
+	if size == 0 {
+		return defaultCacheSize
+	}
+	return size
+}
@@ -0,0 +1,103 @@
+package otfalign
+
+import (
+	"fmt"
+
+	"github.com/iancoleman/strcase"
+	"github.com/nsip/otf-align/api"
+)
+
+//
+// the response returned from an alignment request,
+// see api.AlignResponse
+//
+type AlignResponse = api.AlignResponse
+
+//
+// a single alignment to the NLPs, see api.Alignment
+//
+type Alignment = api.Alignment
+
+//
+// records how an alignment was produced, see api.Provenance
+//
+type Provenance = api.Provenance
+
+//
+// works out the method that produced the alignments from
+// their provenance, and whether fallback occurred.
+//
+// alignments without provenance (e.g. from custom aligners)
+// are taken to come from the requested method
+//
+func summariseProvenance(requested string, alignments []Alignment) (string, bool) {
+
+	effective := ""
+	fallback := false
+	for _, a := range alignments {
+		method := requested
+		if a.Provenance != nil {
+			method = a.Provenance.Method
+			fallback = fallback || a.Provenance.Fallback
+		}
+		switch effective {
+		case "":
+			effective = method
+		case method:
+		default:
+			effective = "mixed"
+		}
+	}
+	if effective == "" {
+		effective = requested
+	}
+
+	return effective, fallback
+}
+
+//
+// assigns a classifier path entry to the matching field
+// of the alignment.
+// a: the alignment to update
+// key: the path key as returned by the classifier e.g. "Sub-element"
+// val: the value for that key
+//
+// keys are normalised to lower-camel case, so variations
+// such as "Sub-element" and "sub element" are treated alike;
+// unrecognised keys are stored in Extras
+//
+func setPathValue(a *Alignment, key string, val interface{}) {
+
+	strVal := ""
+	if val != nil {
+		strVal = fmt.Sprintf("%v", val)
+	}
+
+	normKey := strcase.ToLowerCamel(key) // ensure keys work as json keys
+	switch normKey {
+	case "itemId", "itemID", "item":
+		a.ItemID = strVal
+	case "itemText", "text":
+		a.ItemText = strVal
+	case "developmentLevel", "devLevel":
+		a.DevelopmentLevel = strVal
+	case "generalCapability":
+		a.GeneralCapability = strVal
+	case "element":
+		a.Element = strVal
+	case "subElement":
+		a.SubElement = strVal
+	case "heading":
+		a.Heading = strVal
+	case "progressionLevel":
+		a.ProgressionLevel = strVal
+	case "indicator":
+		a.Indicator = strVal
+	default:
+		if a.Extras == nil {
+			a.Extras = map[string]interface{}{}
+		}
+		a.Extras[normKey] = val
+	}
+
+}
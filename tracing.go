@@ -0,0 +1,176 @@
+package otfalign
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//
+// name of the instrumentation that creates the
+// service's spans
+//
+const tracerName = "github.com/nsip/otf-align"
+
+//
+// collector the otlp exporter sends spans to,
+// if no endpoint has been configured
+//
+const defaultTraceEndpoint = "http://localhost:4318"
+
+//
+// creates the tracer for the configured exporter, and the
+// propagator used to carry w3c trace context in from callers
+// and on to n3w and otf-classifier.
+// trace context is propagated even when no spans are
+// exported, so traces pass through the service intact
+//
+func (s *OtfAlignService) initTracing() error {
+
+	s.propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch s.traceExporter {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		endpoint := s.traceEndpoint
+		if endpoint == "" {
+			endpoint = defaultTraceEndpoint
+		}
+		exporter, err = newOTLPExporter(endpoint)
+	default:
+		s.tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to create trace exporter")
+	}
+
+	ratio := s.traceSampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("otf-align"),
+		semconv.ServiceInstanceID(s.serviceID),
+		attribute.String("otf.align.service_name", s.serviceName),
+	)
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	s.tracer = s.tracerProvider.Tracer(tracerName)
+	return nil
+}
+
+//
+// creates an exporter sending spans over otlp/http to the
+// collector at the endpoint, a url such as http://localhost:4318
+//
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+//
+// flushes any spans not yet exported and stops the exporter
+//
+func (s *OtfAlignService) shutdownTracing() {
+
+	if s.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.tracerProvider.Shutdown(ctx); err != nil {
+		s.log.WithError(err).Error("could not flush traces")
+	}
+}
+
+//
+// continues any trace the caller started, and records each
+// request as a server span.
+// probes and metrics scrapes are not traced
+//
+func (s *OtfAlignService) tracing() echo.MiddlewareFunc {
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := s.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			if quietPaths[c.Path()] {
+				c.SetRequest(req.WithContext(ctx))
+				return next(c)
+			}
+
+			ctx, span := s.tracer.Start(ctx, req.Method+" "+c.Path(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPMethod(req.Method),
+					semconv.HTTPRoute(c.Path()),
+					attribute.String("request.id", c.Response().Header().Get(echo.HeaderXRequestID)),
+				))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			if err != nil {
+				// write the error response now, so its status is recorded
+				c.Error(err)
+			}
+			status := c.Response().Status
+			span.SetAttributes(semconv.HTTPStatusCode(status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, "")
+			}
+			return nil
+		}
+	}
+}
+
+//
+// starts a span for a step of an alignment
+//
+func (s *OtfAlignService) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+//
+// ends the span for a step of an alignment,
+// recording any error
+//
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
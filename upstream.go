@@ -0,0 +1,187 @@
+package otfalign
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nsip/otf-align/internal/util"
+)
+
+//
+// default timeout for each call to an upstream
+// service, if no timeout has been configured
+//
+const defaultUpstreamTimeout = 2 * time.Second
+
+//
+// default number of retries of a failed upstream
+// call, if none have been configured
+//
+const defaultUpstreamRetries = 2
+
+//
+// defaults for ejecting failing upstream replicas,
+// if none have been configured
+//
+const (
+	defaultEjectThreshold = 3
+	defaultEjectTime      = 30 * time.Second
+)
+
+//
+// default paths of the n3w and otf-classifier
+// endpoints called by the service
+//
+const (
+	defaultNiasGraphQLPath = "/n3/graphql"
+	defaultNiasPublishPath = "/n3/publish"
+	defaultNiasContextPath = "/admin/newdemocontext"
+	defaultTcAlignPath     = "/align"
+	defaultTcLookupPath    = "/lookup"
+)
+
+//
+// creates the upstream clients for n3w and
+// otf-classifier from the service configuration,
+// with every call observed for metrics and logging,
+// and traced; their combined calls in flight are capped
+// if a max has been configured
+//
+func (s *OtfAlignService) initUpstreams() error {
+
+	timeout := s.upstreamTimeout
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+	retry := s.retryPolicy
+	switch {
+	case retry.Retries == 0:
+		retry.Retries = defaultUpstreamRetries
+	case retry.Retries < 0:
+		retry.Retries = 0
+	}
+	s.n3w = util.NewUpstream("n3w", timeout, retry,
+		util.NewBreaker(s.breakerThreshold, s.breakerCooldown))
+	s.classifier = util.NewUpstream("otf-classifier", timeout, retry,
+		util.NewBreaker(s.breakerThreshold, s.breakerCooldown))
+	ejectThreshold, ejectTime := s.ejectSettings()
+	s.n3w.Endpoints = util.NewBalancer(s.niasBaseURLs(), s.balancePolicy, ejectThreshold, ejectTime)
+	s.classifier.Endpoints = util.NewBalancer(s.tcBaseURLs(), s.balancePolicy, ejectThreshold, ejectTime)
+	s.defaultEndpointPaths()
+	s.gate = util.NewGate(s.maxUpstreamCalls)
+	for _, up := range []*util.Upstream{s.n3w, s.classifier} {
+		up.Gate = s.gate
+		up.Observer = s.observeUpstream
+		up.Tracer = s.tracer
+		up.Propagator = s.propagator
+	}
+
+	if s.upstreamCAFile != "" || s.upstreamCertFile != "" || s.upstreamKeyFile != "" {
+		cfg, err := util.ClientTLSConfig(s.upstreamCAFile, s.upstreamCertFile, s.upstreamKeyFile)
+		if err != nil {
+			return err
+		}
+		s.n3w.SetTLSConfig(cfg)
+		s.classifier.SetTLSConfig(cfg)
+	}
+	return nil
+}
+
+//
+// the configured settings for ejecting failing
+// upstream replicas, or their defaults
+//
+func (s *OtfAlignService) ejectSettings() (int, time.Duration) {
+
+	threshold := s.ejectThreshold
+	if threshold == 0 {
+		threshold = defaultEjectThreshold
+	}
+	ejectTime := s.ejectTime
+	if ejectTime <= 0 {
+		ejectTime = defaultEjectTime
+	}
+	return threshold, ejectTime
+}
+
+//
+// sets any upstream endpoint paths that have not
+// been configured to their defaults
+//
+func (s *OtfAlignService) defaultEndpointPaths() {
+
+	for _, p := range []struct {
+		path *string
+		def  string
+	}{
+		{&s.niasGraphQLPath, defaultNiasGraphQLPath},
+		{&s.niasPublishPath, defaultNiasPublishPath},
+		{&s.niasContextPath, defaultNiasContextPath},
+		{&s.tcAlignPath, defaultTcAlignPath},
+		{&s.tcLookupPath, defaultTcLookupPath},
+	} {
+		if *p.path == "" {
+			*p.path = p.def
+		}
+	}
+}
+
+//
+// base urls of the n3w servers, either as configured
+// or built from the scheme, host and port
+//
+func (s *OtfAlignService) niasBaseURLs() []string {
+
+	if len(s.niasURLs) > 0 {
+		return s.niasURLs
+	}
+	return []string{baseURL(s.niasScheme, s.niasHost, s.niasPort)}
+}
+
+//
+// base urls of the otf-classifier services, either as
+// configured or built from the scheme, host and port
+//
+func (s *OtfAlignService) tcBaseURLs() []string {
+
+	if len(s.tcURLs) > 0 {
+		return s.tcURLs
+	}
+	return []string{baseURL(s.tcScheme, s.tcHost, s.tcPort)}
+}
+
+func baseURL(scheme, host string, port int) string {
+
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, port)
+}
+
+//
+// records metrics for, and logs, every call
+// made to an upstream
+//
+func (s *OtfAlignService) observeUpstream(ctx context.Context, upstream string, d time.Duration, err error) {
+
+	s.observeUpstreamCall(upstream, d, err)
+	s.logUpstream(ctx, upstream, d, err)
+}
+
+//
+// reports the circuit breaker state of each
+// upstream service, and the state of its replicas
+//
+func (s *OtfAlignService) buildUpstreamStatusHandler() echo.HandlerFunc {
+
+	return func(c echo.Context) error {
+		status := map[string]util.UpstreamStatus{
+			s.n3w.Name:        s.n3w.Status(),
+			s.classifier.Name: s.classifier.Status(),
+		}
+		return c.JSON(http.StatusOK, status)
+	}
+}
@@ -0,0 +1,37 @@
+package otfalign
+
+import (
+	"testing"
+
+	"github.com/nsip/otf-align/internal/util"
+)
+
+func TestUpstreamRetriesDefault(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		options []Option
+		retries int
+	}{
+		{"not set", nil, defaultUpstreamRetries},
+		{"zero", []Option{UpstreamRetries(0)}, defaultUpstreamRetries},
+		{"set", []Option{UpstreamRetries(5)}, 5},
+		{"disabled", []Option{UpstreamRetries(-1)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]Option{Name("test"), ID("test"), Port(1324), CacheSize(-1), LogLevel("error")}, tt.options...)
+			s, err := New(options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.maps.close()
+
+			for _, up := range []*util.Upstream{s.n3w, s.classifier} {
+				if up.Retry.Retries != tt.retries {
+					t.Errorf("%s: expected %d retries, got %d", up.Name, tt.retries, up.Retry.Retries)
+				}
+			}
+		})
+	}
+}
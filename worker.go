@@ -0,0 +1,243 @@
+package otfalign
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nsip/otf-align/internal/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+//
+// number of times a message that failed with a temporary
+// error (upstream unreachable, failing, busy or timed out)
+// is redelivered before being sent to the dead-letter subject
+//
+const maxRedeliveries = 5
+
+//
+// default number of messages aligned concurrently
+// by the worker if no limit has been configured
+//
+const defaultWorkerConcurrency = 8
+
+//
+// the worker consumes otf-reader messages from a nats
+// streaming subject, aligns them, and publishes the
+// enriched messages onward; replacing the benthos
+// alignData workflow
+//
+type worker struct {
+	conn stan.Conn
+	sub  stan.Subscription
+	// bounds the number of messages aligned concurrently
+	sem chan struct{}
+	// tracks messages in progress so shutdown can wait for them
+	wg sync.WaitGroup
+}
+
+//
+// connects to the nats streaming server and starts consuming
+// messages from the ingest subject.
+//
+// messages are acknowledged only once the aligned message (or a
+// dead-letter message on failure) has been published, so any
+// message in progress when the worker stops is redelivered
+//
+func (s *OtfAlignService) StartWorker() error {
+
+	conn, err := stan.Connect(s.natsCluster, s.natsClientID,
+		stan.NatsURL(s.natsURL),
+		stan.SetConnectionLostHandler(func(_ stan.Conn, reason error) {
+			s.log.WithError(reason).Error("nats streaming connection lost")
+		}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to nats streaming server")
+	}
+
+	concurrency := s.workerConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultWorkerConcurrency
+	}
+	w := &worker{conn: conn, sem: make(chan struct{}, concurrency)}
+
+	subOpts := []stan.SubscriptionOption{
+		stan.DurableName(s.natsDurable),
+		stan.SetManualAckMode(),
+		stan.AckWait(30 * time.Second),
+		stan.MaxInflight(concurrency * 2),
+		stan.DeliverAllAvailable(),
+	}
+	handler := func(m *stan.Msg) {
+		// counted before waiting for a slot, so stopWorker
+		// cannot miss a message that is about to start
+		w.wg.Add(1)
+		w.sem <- struct{}{}
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.sem }()
+			s.handleIngestMessage(w.conn, m, m.Ack)
+		}()
+	}
+	if s.natsQueue != "" {
+		w.sub, err = conn.QueueSubscribe(s.ingestSubject, s.natsQueue, handler, subOpts...)
+	} else {
+		w.sub, err = conn.Subscribe(s.ingestSubject, handler, subOpts...)
+	}
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "cannot subscribe to ingest subject")
+	}
+
+	s.worker = w
+	return nil
+}
+
+//
+// stops consuming messages and waits for any messages
+// in progress to complete.
+// the durable subscription is kept so the worker resumes
+// from where it left off when restarted
+//
+func (s *OtfAlignService) stopWorker() {
+
+	w := s.worker
+	if w == nil {
+		return
+	}
+	if err := w.sub.Close(); err != nil {
+		s.log.WithError(err).Error("could not close ingest subscription cleanly")
+	}
+	w.wg.Wait()
+	if err := w.conn.Close(); err != nil {
+		s.log.WithError(err).Error("could not close nats streaming connection cleanly")
+	}
+	s.worker = nil
+}
+
+//
+// publishes messages to a nats streaming subject,
+// as a stan.Conn does
+//
+type publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+//
+// aligns a single ingest message and publishes the result.
+// ack acknowledges the message, and is only called once the
+// result or dead-letter message has been published
+//
+func (s *OtfAlignService) handleIngestMessage(conn publisher, m *stan.Msg, ack func() error) {
+
+	start := time.Now()
+	l := s.log.WithFields(logrus.Fields{
+		"requestID":    util.GenerateID(),
+		"subject":      m.Subject,
+		"sequence":     m.Sequence,
+		"redeliveries": m.RedeliveryCount,
+	})
+	ctx := withLogger(s.baseCtx, l)
+
+	enriched, skip, err := s.alignEnvelope(ctx, m.Data)
+	l = l.WithField("durationMs", millis(time.Since(start)))
+	switch {
+	case skip:
+		// nothing to align, drop the message as benthos did
+		l.Info("skipping message, no alignment required")
+	case err != nil:
+		if temporary(err) && m.RedeliveryCount < maxRedeliveries {
+			// leave unacknowledged to be redelivered
+			l.WithError(err).Warn("message will be redelivered")
+			return
+		}
+		if perr := s.publishDeadLetter(conn, m, err); perr != nil {
+			l.WithError(perr).Error("message could not be dead-lettered")
+			return
+		}
+		l.WithError(err).Warn("message dead-lettered")
+	default:
+		if perr := conn.Publish(s.alignedSubject, enriched); perr != nil {
+			l.WithError(perr).Error("message could not be published")
+			return
+		}
+		l.Info("message aligned")
+	}
+
+	if err := ack(); err != nil {
+		l.WithError(err).Error("message could not be acknowledged")
+	}
+}
+
+//
+// publishes a failed message, with the reason for the
+// failure, to the dead-letter subject
+//
+func (s *OtfAlignService) publishDeadLetter(conn publisher, m *stan.Msg, cause error) error {
+
+	msg := json.RawMessage(m.Data)
+	if !json.Valid(m.Data) {
+		quoted, _ := json.Marshal(string(m.Data))
+		msg = json.RawMessage(quoted)
+	}
+	dl, err := json.Marshal(map[string]interface{}{
+		"error":            errorMessage(cause),
+		"subject":          m.Subject,
+		"sequence":         m.Sequence,
+		"redeliveries":     m.RedeliveryCount,
+		"alignServiceID":   s.serviceID,
+		"alignServiceName": s.serviceName,
+		"message":          msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	return conn.Publish(s.deadLetterSubject, dl)
+}
+
+//
+// returns true if the error is likely to clear if the
+// message is tried again later, judged by its cause:
+// an upstream that could not be reached, failed, was
+// overloaded or timed out, too many upstream calls in
+// flight, or the service shutting down
+//
+func temporary(err error) bool {
+
+	cause := err
+	if he, ok := err.(*echo.HTTPError); ok {
+		// the service is busy, the cause is replaced
+		// by when to try again
+		if he.Code == http.StatusTooManyRequests {
+			return true
+		}
+		if he.Internal == nil {
+			return false
+		}
+		cause = he.Internal
+	}
+	return util.Temporary(cause) ||
+		errors.Is(cause, context.DeadlineExceeded) ||
+		errors.Is(cause, context.Canceled)
+}
+
+//
+// the message to report for an error, using the
+// message of an echo.HTTPError where available
+//
+func errorMessage(err error) string {
+
+	if he, ok := err.(*echo.HTTPError); ok {
+		return fmt.Sprintf("%v", he.Message)
+	}
+	return err.Error()
+}
@@ -0,0 +1,167 @@
+package otfalign
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	"github.com/nsip/otf-align/internal/util"
+	"github.com/pkg/errors"
+)
+
+func TestTemporary(t *testing.T) {
+
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		name      string
+		err       error
+		temporary bool
+	}{
+		{"429 too many requests", tooManyRequests("rate limit exceeded", 0), true},
+		{"too many upstream calls", alignError(errors.Wrap(util.ErrTooManyCalls, "n3w not called")), true},
+		{"circuit open", alignError(errors.Wrap(util.ErrCircuitOpen, "n3w unavailable")), true},
+		{"upstream 5xx", alignError(errors.Wrap(&util.StatusError{Code: http.StatusBadGateway}, "n3w call failed")), true},
+		{"upstream 501", alignError(errors.Wrap(&util.StatusError{Code: http.StatusNotImplemented}, "n3w call failed")), false},
+		{"upstream 4xx", alignError(errors.Wrap(&util.StatusError{Code: http.StatusBadRequest}, "n3w call failed")), false},
+		{"upstream unreachable", alignError(errors.Wrap(dial, "n3w call failed")), true},
+		{"deadline", alignError(errors.Wrap(context.DeadlineExceeded, "n3w call abandoned")), true},
+		{"shutting down", alignError(errors.Wrap(context.Canceled, "n3w call abandoned")), true},
+		{"bad request", echo.NewHTTPError(http.StatusBadRequest, "no token"), false},
+		{"service unavailable without cause", echo.NewHTTPError(http.StatusServiceUnavailable, "unavailable"), false},
+		{"other error", alignError(errors.New("cannot decode response")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := temporary(tt.err); got != tt.temporary {
+				t.Errorf("temporary(%v) = %v, expected %v", tt.err, got, tt.temporary)
+			}
+		})
+	}
+}
+
+// aligns every request with the same result or error
+type stubAligner struct {
+	err error
+}
+
+func (a stubAligner) Name() string { return "mapped" }
+
+func (a stubAligner) Align(ctx context.Context, ar *AlignRequest) ([]Alignment, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return []Alignment{{ItemID: "uri/version/nlp-1"}}, nil
+}
+
+// records published messages, failing if told to
+type stubPublisher struct {
+	err       error
+	published map[string][][]byte
+}
+
+func (p *stubPublisher) Publish(subject string, data []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.published == nil {
+		p.published = map[string][][]byte{}
+	}
+	p.published[subject] = append(p.published[subject], data)
+	return nil
+}
+
+func TestHandleIngestMessage(t *testing.T) {
+
+	ingest := []byte(`{
+		"meta": {"providerName": "MathsPathway", "alignMethod": "mapped", "capability": "numeracy"},
+		"original": {"module_id": "00e6a88e", "student_id": "ac4f28ee"}
+	}`)
+	upstreamDown := errors.Wrap(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, "n3w call failed")
+
+	tests := []struct {
+		name string
+		// error returned by the aligner
+		alignErr error
+		// error returned when publishing
+		publishErr   error
+		message      []byte
+		redeliveries uint32
+		// expected outcome
+		acked        bool
+		aligned      bool
+		deadLettered string
+	}{
+		{name: "aligned", message: ingest, acked: true, aligned: true},
+		{name: "publish fails", message: ingest, publishErr: errors.New("nats down")},
+		{name: "temporary failure", message: ingest, alignErr: upstreamDown},
+		{name: "temporary failure at limit", message: ingest, alignErr: upstreamDown,
+			redeliveries: maxRedeliveries, acked: true, deadLettered: "connection refused"},
+		{name: "permanent failure", message: ingest, alignErr: errors.New("cannot decode response"),
+			acked: true, deadLettered: "cannot decode response"},
+		{name: "invalid message", message: []byte(`{"meta": `), acked: true, deadLettered: "not valid json"},
+		{name: "unknown provider", message: []byte(`{"meta": {"providerName": "Nobody"}, "original": {}}`),
+			acked: true, deadLettered: "Nobody"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Name("test"), ID("test"), Port(1324), CacheSize(-1), LogLevel("error"),
+				IngestSubject(""), AlignedSubject(""), DeadLetterSubject(""),
+				Aligners(stubAligner{err: tt.alignErr}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.maps.close()
+
+			conn := &stubPublisher{err: tt.publishErr}
+			acked := false
+			m := &stan.Msg{MsgProto: pb.MsgProto{
+				Subject:         s.ingestSubject,
+				Sequence:        7,
+				Data:            tt.message,
+				RedeliveryCount: tt.redeliveries,
+			}}
+			s.handleIngestMessage(conn, m, func() error {
+				acked = true
+				return nil
+			})
+
+			if acked != tt.acked {
+				t.Errorf("expected acked %v, got %v", tt.acked, acked)
+			}
+			if aligned := len(conn.published[s.alignedSubject]) == 1; aligned != tt.aligned {
+				t.Errorf("expected aligned message published %v, got %v", tt.aligned, aligned)
+			}
+			dead := conn.published[s.deadLetterSubject]
+			if tt.deadLettered == "" {
+				if len(dead) != 0 {
+					t.Errorf("expected no dead-letter message, got %s", dead[0])
+				}
+				return
+			}
+			if len(dead) != 1 {
+				t.Fatalf("expected a dead-letter message, got %d", len(dead))
+			}
+			var dl struct {
+				Error        string          `json:"error"`
+				Sequence     uint64          `json:"sequence"`
+				Redeliveries uint32          `json:"redeliveries"`
+				Message      json.RawMessage `json:"message"`
+			}
+			if err := json.Unmarshal(dead[0], &dl); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(dl.Error, tt.deadLettered) {
+				t.Errorf("expected dead-letter reason containing %q, got %q", tt.deadLettered, dl.Error)
+			}
+			if dl.Sequence != 7 || dl.Redeliveries != tt.redeliveries || len(dl.Message) == 0 {
+				t.Errorf("dead-letter message missing details of the original: %s", dead[0])
+			}
+		})
+	}
+}